@@ -0,0 +1,9 @@
+// Package mgbothelper holds assets embedded in the bot binary
+package mgbothelper
+
+import "embed"
+
+// Assets holds migrations, templates, translations and static files
+//
+//go:embed migrations templates translate static
+var Assets embed.FS
@@ -1 +1 @@
-DROP TABLE connection;
+DROP TABLE {{.Prefix}}connection;
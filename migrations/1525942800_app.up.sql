@@ -1,6 +1,6 @@
-create table connection
+create table {{.Prefix}}connection
 (
-  id         serial not null constraint connection_pkey primary key,
+  id         serial not null constraint {{.Prefix}}connection_pkey primary key,
   client_id  varchar(70) not null,
   api_key    varchar(100) not null,
   api_url    varchar(255) not null,
@@ -13,5 +13,5 @@ create table connection
   lang     varchar(2) not null
 );
 
-alter table connection
-  add constraint connection_key unique (client_id, mg_token);
+alter table {{.Prefix}}connection
+  add constraint {{.Prefix}}connection_key unique (client_id, mg_token);
@@ -1 +1 @@
-alter table connection drop column currency
+alter table {{.Prefix}}connection drop column currency
@@ -1 +1 @@
-alter table connection add column currency varchar(12);
+alter table {{.Prefix}}connection add column currency varchar(12);
@@ -0,0 +1,2 @@
+DROP TABLE {{.Prefix}}connection_lease;
+DROP TABLE {{.Prefix}}instance;
@@ -0,0 +1,14 @@
+create table {{.Prefix}}instance
+(
+  id           varchar(64) not null constraint {{.Prefix}}instance_pkey primary key,
+  heartbeat_at timestamp with time zone not null
+);
+
+create table {{.Prefix}}connection_lease
+(
+  client_id   varchar(70) not null constraint {{.Prefix}}connection_lease_pkey primary key,
+  instance_id varchar(64) not null,
+  expires_at  timestamp with time zone not null
+);
+
+create index {{.Prefix}}connection_lease_instance_id_idx on {{.Prefix}}connection_lease (instance_id);
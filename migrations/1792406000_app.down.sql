@@ -0,0 +1 @@
+DROP TABLE {{.Prefix}}processed_message;
@@ -0,0 +1,9 @@
+create table {{.Prefix}}processed_message
+(
+  client_id  varchar(70) not null,
+  message_id bigint not null,
+  created_at timestamp with time zone not null,
+  constraint {{.Prefix}}processed_message_pkey primary key (client_id, message_id)
+);
+
+create index {{.Prefix}}processed_message_created_at_idx on {{.Prefix}}processed_message (created_at);
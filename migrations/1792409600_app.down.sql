@@ -0,0 +1 @@
+DROP TABLE {{.Prefix}}outbox_message;
@@ -0,0 +1,14 @@
+create table {{.Prefix}}outbox_message
+(
+  id              serial not null constraint {{.Prefix}}outbox_message_pkey primary key,
+  client_id       varchar(70) not null,
+  payload         jsonb not null,
+  status          varchar(16) not null,
+  attempts        integer not null default 0,
+  last_error      text,
+  next_attempt_at timestamp with time zone not null,
+  created_at      timestamp with time zone,
+  updated_at      timestamp with time zone
+);
+
+create index {{.Prefix}}outbox_message_status_idx on {{.Prefix}}outbox_message (status, next_attempt_at);
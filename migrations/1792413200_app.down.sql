@@ -0,0 +1,2 @@
+alter table {{.Prefix}}connection drop column chat_rate_limit;
+alter table {{.Prefix}}connection drop column connection_rate_limit;
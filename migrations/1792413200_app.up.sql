@@ -0,0 +1,2 @@
+alter table {{.Prefix}}connection add column chat_rate_limit integer not null default 0;
+alter table {{.Prefix}}connection add column connection_rate_limit integer not null default 0;
@@ -0,0 +1 @@
+alter table {{.Prefix}}connection add column realtime_stock boolean not null default false;
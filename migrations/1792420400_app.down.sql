@@ -0,0 +1 @@
+alter table {{.Prefix}}connection drop column broken;
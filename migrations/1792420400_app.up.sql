@@ -0,0 +1 @@
+alter table {{.Prefix}}connection add column broken boolean not null default false;
@@ -0,0 +1,3 @@
+alter table {{.Prefix}}connection
+  alter column api_key type varchar(100),
+  alter column mg_token type varchar(100);
@@ -0,0 +1,3 @@
+alter table {{.Prefix}}connection
+  alter column api_key type text,
+  alter column mg_token type text;
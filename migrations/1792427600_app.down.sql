@@ -0,0 +1 @@
+drop table {{.Prefix}}audit_record;
@@ -0,0 +1,14 @@
+create table {{.Prefix}}audit_record
+(
+  id         serial not null constraint {{.Prefix}}audit_record_pkey primary key,
+  client_id  varchar(70) not null,
+  action     varchar(32) not null,
+  source     varchar(16) not null,
+  changes    jsonb not null,
+  created_at timestamp with time zone not null
+);
+
+create index {{.Prefix}}audit_record_client_id_idx on {{.Prefix}}audit_record (client_id, id);
+
+create rule {{.Prefix}}audit_record_no_update as on update to {{.Prefix}}audit_record do instead nothing;
+create rule {{.Prefix}}audit_record_no_delete as on delete to {{.Prefix}}audit_record do instead nothing;
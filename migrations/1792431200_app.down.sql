@@ -0,0 +1,3 @@
+delete from {{.Prefix}}connection where deleted_at is not null;
+
+alter table {{.Prefix}}connection drop column deleted_at;
@@ -0,0 +1,3 @@
+alter table {{.Prefix}}connection add column deleted_at timestamp with time zone;
+
+create index {{.Prefix}}connection_deleted_at_idx on {{.Prefix}}connection (deleted_at);
@@ -0,0 +1 @@
+alter table {{.Prefix}}outbox_message drop column trace_parent;
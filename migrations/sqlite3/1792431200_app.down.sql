@@ -0,0 +1,6 @@
+drop table if exists {{.Prefix}}audit_record;
+drop table if exists {{.Prefix}}outbox_message;
+drop table if exists {{.Prefix}}processed_message;
+drop table if exists {{.Prefix}}connection_lease;
+drop table if exists {{.Prefix}}instance;
+drop table if exists {{.Prefix}}connection;
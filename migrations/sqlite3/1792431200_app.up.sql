@@ -0,0 +1,85 @@
+create table {{.Prefix}}connection
+(
+  id                    integer not null constraint {{.Prefix}}connection_pkey primary key autoincrement,
+  client_id             varchar(70) not null,
+  api_key               text not null,
+  api_url               varchar(255) not null,
+  mg_url                varchar(255) not null,
+  mg_token              text not null,
+  commands              text,
+  created_at            datetime,
+  updated_at            datetime,
+  deleted_at            datetime,
+  active                boolean,
+  lang                  varchar(2) not null,
+  currency              varchar(12),
+  chat_rate_limit       integer not null default 0,
+  connection_rate_limit integer not null default 0,
+  realtime_stock        boolean not null default false,
+  broken                boolean not null default false,
+  constraint {{.Prefix}}connection_key unique (client_id, mg_token)
+);
+
+create index {{.Prefix}}connection_deleted_at_idx on {{.Prefix}}connection (deleted_at);
+
+create table {{.Prefix}}instance
+(
+  id           varchar(64) not null constraint {{.Prefix}}instance_pkey primary key,
+  heartbeat_at datetime not null
+);
+
+create table {{.Prefix}}connection_lease
+(
+  client_id   varchar(70) not null constraint {{.Prefix}}connection_lease_pkey primary key,
+  instance_id varchar(64) not null,
+  expires_at  datetime not null
+);
+
+create index {{.Prefix}}connection_lease_instance_id_idx on {{.Prefix}}connection_lease (instance_id);
+
+create table {{.Prefix}}processed_message
+(
+  client_id  varchar(70) not null,
+  message_id bigint not null,
+  created_at datetime not null,
+  constraint {{.Prefix}}processed_message_pkey primary key (client_id, message_id)
+);
+
+create index {{.Prefix}}processed_message_created_at_idx on {{.Prefix}}processed_message (created_at);
+
+create table {{.Prefix}}outbox_message
+(
+  id              integer not null constraint {{.Prefix}}outbox_message_pkey primary key autoincrement,
+  client_id       varchar(70) not null,
+  payload         text not null,
+  status          varchar(16) not null,
+  attempts        integer not null default 0,
+  last_error      text,
+  next_attempt_at datetime not null,
+  created_at      datetime,
+  updated_at      datetime
+);
+
+create index {{.Prefix}}outbox_message_status_idx on {{.Prefix}}outbox_message (status, next_attempt_at);
+
+create table {{.Prefix}}audit_record
+(
+  id         integer not null constraint {{.Prefix}}audit_record_pkey primary key autoincrement,
+  client_id  varchar(70) not null,
+  action     varchar(32) not null,
+  source     varchar(16) not null,
+  changes    text not null,
+  created_at datetime not null
+);
+
+create index {{.Prefix}}audit_record_client_id_idx on {{.Prefix}}audit_record (client_id, id);
+
+create trigger {{.Prefix}}audit_record_no_update before update on {{.Prefix}}audit_record
+begin
+  select raise(ignore);
+end;
+
+create trigger {{.Prefix}}audit_record_no_delete before delete on {{.Prefix}}audit_record
+begin
+  select raise(ignore);
+end;
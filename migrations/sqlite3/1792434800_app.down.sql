@@ -0,0 +1,20 @@
+create table {{.Prefix}}outbox_message_down
+(
+  id              integer not null constraint {{.Prefix}}outbox_message_pkey primary key autoincrement,
+  client_id       varchar(70) not null,
+  payload         text not null,
+  status          varchar(16) not null,
+  attempts        integer not null default 0,
+  last_error      text,
+  next_attempt_at datetime not null,
+  created_at      datetime,
+  updated_at      datetime
+);
+
+insert into {{.Prefix}}outbox_message_down (id, client_id, payload, status, attempts, last_error, next_attempt_at, created_at, updated_at)
+select id, client_id, payload, status, attempts, last_error, next_attempt_at, created_at, updated_at from {{.Prefix}}outbox_message;
+
+drop table {{.Prefix}}outbox_message;
+alter table {{.Prefix}}outbox_message_down rename to {{.Prefix}}outbox_message;
+
+create index {{.Prefix}}outbox_message_status_idx on {{.Prefix}}outbox_message (status, next_attempt_at);
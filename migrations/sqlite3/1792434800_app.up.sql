@@ -0,0 +1 @@
+alter table {{.Prefix}}outbox_message add column trace_parent varchar(55);
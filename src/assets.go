@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+
+	mgbothelper "github.com/retailcrm/mg-bot-helper"
+)
+
+// assets holds migrations, templates, translations and static files,
+// embedded ones are overridden by files of config.AssetsDir
+var assets fs.FS = mgbothelper.Assets
+
+// overlayFS opens files from the first layer containing them
+type overlayFS []fs.FS
+
+// newAssets returns embedded assets overridden by files of dir if it is set
+func newAssets(dir string) fs.FS {
+	if dir == "" {
+		return mgbothelper.Assets
+	}
+
+	return overlayFS{os.DirFS(dir), mgbothelper.Assets}
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	err := error(fs.ErrNotExist)
+	for _, layer := range o {
+		var f fs.File
+		if f, err = layer.Open(name); err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+
+	return nil, err
+}
+
+// ReadDir merges entries of the directory in all layers
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	seen := map[string]bool{}
+	found := false
+
+	var entries []fs.DirEntry
+	for _, layer := range o {
+		layerEntries, err := fs.ReadDir(layer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+		for _, e := range layerEntries {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// staticFileSystem serves static assets without directory listing
+type staticFileSystem struct {
+	http.FileSystem
+}
+
+func newStaticFileSystem() http.FileSystem {
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return staticFileSystem{http.FS(static)}
+}
+
+func (s staticFileSystem) Open(name string) (http.File, error) {
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat, err := f.Stat(); err == nil && stat.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
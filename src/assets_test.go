@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssets_newAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mg-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "templates", "home.html"), []byte("custom"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "templates", "extra.html"), []byte("extra"), 0644)
+
+	a := newAssets(dir)
+
+	home, err := fs.ReadFile(a, "templates/home.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", string(home))
+
+	_, err = fs.ReadFile(a, "templates/form.html")
+	assert.NoError(t, err)
+
+	files, err := fs.ReadDir(a, "templates")
+	assert.NoError(t, err)
+	assert.Len(t, files, 4)
+
+	_, err = fs.ReadDir(a, "translate")
+	assert.NoError(t, err)
+
+	_, err = fs.ReadDir(a, "unknown")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAssets_static(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/static/script.js", nil)
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/static/", nil)
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	AuditSourceUI    = "ui"
+	AuditSourceCRM   = "crm"
+	AuditSourceCLI   = "cli"
+	AuditSourceAdmin = "admin"
+)
+
+// AuditChange holds old and new value of the changed field
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// maskSecret keeps only the last characters of the secret
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+
+	return strings.Repeat("*", 4) + s[len(s)-4:]
+}
+
+// connectionChanges returns fields differing in connection before and after change,
+// secrets are masked
+func connectionChanges(before, after *Connection) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+
+	add := func(field string, o, n interface{}) {
+		if o != n {
+			changes[field] = AuditChange{Old: o, New: n}
+		}
+	}
+	addSecret := func(field string, o, n string) {
+		if o != n {
+			changes[field] = AuditChange{Old: maskSecret(o), New: maskSecret(n)}
+		}
+	}
+
+	add("api_url", before.APIURL, after.APIURL)
+	addSecret("api_key", before.APIKEY, after.APIKEY)
+	add("mg_url", before.MGURL, after.MGURL)
+	addSecret("mg_token", before.MGToken, after.MGToken)
+	add("active", before.Active, after.Active)
+	add("lang", before.Lang, after.Lang)
+	add("currency", before.Currency, after.Currency)
+	add("realtime_stock", before.RealtimeStock, after.RealtimeStock)
+	add("chat_rate_limit", before.ChatRateLimit, after.ChatRateLimit)
+	add("connection_rate_limit", before.ConnectionRateLimit, after.ConnectionRateLimit)
+
+	return changes
+}
+
+// auditConnection records change of the connection made by action from source
+func auditConnection(repo ConnectionRepository, source, action string, before, after *Connection) {
+	auditChanges(repo, source, action, after.ClientID, connectionChanges(before, after))
+}
+
+// auditChanges appends record to the audit log, failures are only logged
+// to keep the change itself
+func auditChanges(repo ConnectionRepository, source, action, clientID string, changes map[string]AuditChange) {
+	log := withFields(logger, LogFields{"audit": action, "source": source, "client_id": clientID})
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		log.Errorf("audit: %v", err)
+		return
+	}
+
+	record := AuditRecord{
+		ClientID: clientID,
+		Action:   action,
+		Source:   source,
+		Changes:  JSON{RawMessage: data},
+	}
+
+	if err := repo.AddAudit(&record); err != nil {
+		log.Errorf("audit: %v", err)
+		return
+	}
+
+	log.Infof("audit: connection %s changed by %s: %s", clientID, action, data)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit_maskSecret(t *testing.T) {
+	assert.Equal(t, "", maskSecret(""))
+	assert.Equal(t, "*****", maskSecret("short"))
+	assert.Equal(t, "****9fj3", maskSecret("988730985u23r390rf8j3984jf32904fj9fj3"))
+}
+
+func TestAudit_connectionChanges(t *testing.T) {
+	before := &Connection{
+		APIURL:   crmUrl,
+		APIKEY:   "ii32if32iuf23iufn2uifnr23inf",
+		Active:   true,
+		Lang:     "ru",
+		Currency: "rub",
+	}
+
+	after := *before
+	after.APIKEY = "ii32if32iuf23iufn2uifnr2test"
+	after.Lang = "en"
+
+	changes := connectionChanges(before, &after)
+
+	assert.Len(t, changes, 2)
+	assert.Equal(t, AuditChange{Old: "ru", New: "en"}, changes["lang"])
+	assert.Equal(t, AuditChange{Old: "****3inf", New: "****test"}, changes["api_key"])
+	assert.NotContains(t, changes, "currency")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker stops calls to a failing service after a number of
+// consecutive failures and lets probe calls through once the open timeout
+// has passed.
+type CircuitBreaker struct {
+	mutex            sync.Mutex
+	state            string
+	failures         int
+	threshold        int
+	openTimeout      time.Duration
+	openedAt         time.Time
+	halfOpenRequests int
+	probes           int
+	successes        int
+}
+
+// NewCircuitBreaker returns closed breaker configured by c
+func NewCircuitBreaker(c CircuitBreakerConfig) *CircuitBreaker {
+	b := &CircuitBreaker{
+		state:            BreakerClosed,
+		threshold:        c.Failures,
+		openTimeout:      time.Duration(c.OpenTimeout) * time.Second,
+		halfOpenRequests: c.HalfOpenRequests,
+	}
+
+	if b.threshold <= 0 {
+		b.threshold = 5
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = 30 * time.Second
+	}
+	if b.halfOpenRequests <= 0 {
+		b.halfOpenRequests = 1
+	}
+
+	return b
+}
+
+// Do calls fn unless the breaker is open, an error returned by fn counts as
+// a failure of the service.
+func (b *CircuitBreaker) Do(fn func() error) error {
+	if !b.before() {
+		return errBreakerOpen
+	}
+
+	err := fn()
+	b.after(err == nil)
+
+	return err
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openTimeout {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+func (b *CircuitBreaker) before() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.halfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+
+	return true
+}
+
+func (b *CircuitBreaker) after(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		if !success {
+			b.open()
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+		return
+	}
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open()
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+}
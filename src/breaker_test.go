@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerConfig{Failures: 2, OpenTimeout: 1})
+	fail := func() error { return errors.New("crm is down") }
+	succeed := func() error { return nil }
+
+	b.Do(fail)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	b.Do(fail)
+	assert.Equal(t, BreakerOpen, b.State(), "breaker must open after consecutive failures")
+	assert.Equal(t, errBreakerOpen, b.Do(succeed), "open breaker must not call the service")
+
+	b.openedAt = time.Now().Add(-time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+
+	b.Do(fail)
+	assert.Equal(t, BreakerOpen, b.State(), "failed probe must open breaker again")
+
+	b.openedAt = time.Now().Add(-time.Second)
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, BreakerClosed, b.State(), "successful probe must close breaker")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Cluster coordinates the ownership of connections between bot instances
+// through leases stored in the database.
+type Cluster struct {
+	id       string
+	ttl      time.Duration
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewCluster returns the cluster membership of the current instance
+func NewCluster(c ClusterConfig) *Cluster {
+	id := c.InstanceID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%s", host, GenerateToken()[:8])
+	}
+
+	ttl := time.Duration(c.LeaseTTL) * time.Second
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+
+	interval := time.Duration(c.RenewInterval) * time.Second
+	if interval <= 0 || interval >= ttl {
+		interval = ttl / 3
+	}
+
+	return &Cluster{
+		id:       id,
+		ttl:      ttl,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (c *Cluster) acquire(clientID string) bool {
+	now := time.Now()
+	ok, err := acquireLease(clientID, c.id, now, now.Add(c.ttl))
+	if err != nil {
+		logger.Errorf("cluster %s: acquire lease %s: %v", c.id, clientID, err)
+		return false
+	}
+
+	return ok
+}
+
+func (c *Cluster) release(clientID string) {
+	if err := releaseLease(clientID, c.id); err != nil {
+		logger.Errorf("cluster %s: release lease %s: %v", c.id, clientID, err)
+	}
+}
+
+// share reports the heartbeat of the instance and returns the number of
+// connections it should own to spread the total evenly between live instances.
+func (c *Cluster) share(total int) int {
+	now := time.Now()
+	if err := heartbeatInstance(c.id, now); err != nil {
+		logger.Errorf("cluster %s: heartbeat: %v", c.id, err)
+	}
+
+	if err := deleteStaleInstances(now.Add(-10 * c.ttl)); err != nil {
+		logger.Errorf("cluster %s: delete stale instances: %v", c.id, err)
+	}
+
+	n, err := countLiveInstances(now.Add(-c.ttl))
+	if err != nil {
+		logger.Errorf("cluster %s: count instances: %v", c.id, err)
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return (total + n - 1) / n
+}
+
+// leave releases all leases of the instance so that others can take them over
+// without waiting for expiration.
+func (c *Cluster) leave() {
+	close(c.stop)
+
+	if err := releaseInstanceLeases(c.id); err != nil {
+		logger.Errorf("cluster %s: release leases: %v", c.id, err)
+	}
+
+	if err := deleteInstance(c.id); err != nil {
+		logger.Errorf("cluster %s: delete instance: %v", c.id, err)
+	}
+}
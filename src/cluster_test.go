@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster_acquire(t *testing.T) {
+	requireDB(t)
+
+	a := NewCluster(ClusterConfig{InstanceID: "instance-a", LeaseTTL: 30})
+	b := NewCluster(ClusterConfig{InstanceID: "instance-b", LeaseTTL: 30})
+	defer releaseInstanceLeases(a.id)
+	defer releaseInstanceLeases(b.id)
+
+	assert.True(t, a.acquire(clientID), "free lease must be acquired")
+	assert.False(t, b.acquire(clientID), "lease held by another instance must not be acquired")
+	assert.True(t, a.acquire(clientID), "own lease must be renewed")
+
+	a.release(clientID)
+	assert.True(t, b.acquire(clientID), "released lease must be acquired")
+}
+
+func TestCluster_takeover(t *testing.T) {
+	requireDB(t)
+
+	a := NewCluster(ClusterConfig{InstanceID: "instance-a", LeaseTTL: 30})
+	b := NewCluster(ClusterConfig{InstanceID: "instance-b", LeaseTTL: 30})
+	defer releaseInstanceLeases(a.id)
+	defer releaseInstanceLeases(b.id)
+
+	now := time.Now()
+	ok, err := acquireLease(clientID, a.id, now.Add(-time.Minute), now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, ok)
+	assert.True(t, b.acquire(clientID), "expired lease must be taken over")
+	assert.False(t, a.acquire(clientID))
+}
+
+func TestCluster_share(t *testing.T) {
+	requireDB(t)
+
+	a := NewCluster(ClusterConfig{InstanceID: "instance-a", LeaseTTL: 30})
+	b := NewCluster(ClusterConfig{InstanceID: "instance-b", LeaseTTL: 30})
+	defer deleteInstance(a.id)
+	defer deleteInstance(b.id)
+
+	assert.Equal(t, 3, a.share(3))
+	assert.Equal(t, 2, b.share(3), "connections must be split between live instances")
+
+	a.leave()
+	assert.Equal(t, 3, b.share(3), "connections of the instance gone must be taken over")
+}
+
+func TestWorkersManager_balance(t *testing.T) {
+	defer useSqlite(t)()
+
+	repo := NewMemoryConnectionRepository()
+	for _, id := range []string{"balance-a", "balance-b", "balance-c"} {
+		repo.Create(&Connection{ClientID: id, APIURL: crmUrl, MGURL: "https://test.retailcrm.pro", Active: true})
+	}
+
+	a := NewWorkersManager(repo)
+	a.cluster = NewCluster(ClusterConfig{InstanceID: "instance-a", LeaseTTL: 30})
+	b := NewWorkersManager(repo)
+	b.cluster = NewCluster(ClusterConfig{InstanceID: "instance-b", LeaseTTL: 30})
+	defer a.stopCluster()
+	defer b.stopCluster()
+
+	assert.Len(t, a.balance(), 3, "free connections must be taken over")
+	assert.Empty(t, a.balance(), "running workers must be kept")
+	assert.Equal(t, 3, a.size())
+
+	assert.Empty(t, b.balance(), "leases of the other instance must not be taken")
+	assert.Empty(t, a.balance(), "connections above the share must be given away")
+	assert.Equal(t, 2, a.size())
+	assert.Len(t, b.balance(), 1)
+	assert.Equal(t, 1, b.size())
+}
@@ -10,13 +10,28 @@ import (
 
 // BotConfig struct
 type BotConfig struct {
-	Version    string           `yaml:"version"`
-	LogLevel   logging.Level    `yaml:"log_level"`
-	Database   DatabaseConfig   `yaml:"database"`
-	SentryDSN  string           `yaml:"sentry_dsn"`
-	HTTPServer HTTPServerConfig `yaml:"http_server"`
-	Debug      bool             `yaml:"debug"`
-	BotInfo    BotInfo          `yaml:"bot_info"`
+	Version        string               `yaml:"version"`
+	LogLevel       logging.Level        `yaml:"log_level"`
+	LogFormat      string               `yaml:"log_format"`
+	Database       DatabaseConfig       `yaml:"database"`
+	SentryDSN      string               `yaml:"sentry_dsn"`
+	HTTPServer     HTTPServerConfig     `yaml:"http_server"`
+	Debug          bool                 `yaml:"debug"`
+	BotInfo        BotInfo              `yaml:"bot_info"`
+	Cluster        ClusterConfig        `yaml:"cluster"`
+	Dedup          DedupConfig          `yaml:"dedup"`
+	Outbox         OutboxConfig         `yaml:"outbox"`
+	Admin          AdminConfig          `yaml:"admin"`
+	Startup        StartupConfig        `yaml:"startup"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Cache          CacheConfig          `yaml:"cache"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	AuthFailures   int                  `yaml:"auth_failures"`
+	Encryption     EncryptionConfig     `yaml:"encryption"`
+	Session        SessionConfig        `yaml:"session"`
+	Uninstall      UninstallConfig      `yaml:"uninstall"`
+	AssetsDir      string               `yaml:"assets_dir"`
 }
 
 type BotInfo struct {
@@ -35,6 +50,90 @@ type DatabaseConfig struct {
 	ConnectionLifetime int    `yaml:"connection_lifetime"`
 }
 
+// ClusterConfig struct
+type ClusterConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	InstanceID    string `yaml:"instance_id"`
+	LeaseTTL      int    `yaml:"lease_ttl"`
+	RenewInterval int    `yaml:"renew_interval"`
+}
+
+// DedupConfig struct
+type DedupConfig struct {
+	CacheSize  int  `yaml:"cache_size"`
+	Persistent bool `yaml:"persistent"`
+	TTL        int  `yaml:"ttl"`
+}
+
+// OutboxConfig struct
+type OutboxConfig struct {
+	MaxAttempts   int `yaml:"max_attempts"`
+	RetryDelay    int `yaml:"retry_delay"`
+	MaxRetryDelay int `yaml:"max_retry_delay"`
+	BatchSize     int `yaml:"batch_size"`
+}
+
+// AdminConfig struct
+type AdminConfig struct {
+	Login    string `yaml:"login"`
+	Password string `yaml:"password"`
+}
+
+// StartupConfig struct
+type StartupConfig struct {
+	Window      int `yaml:"window"`
+	Concurrency int `yaml:"concurrency"`
+}
+
+// RateLimitConfig struct
+type RateLimitConfig struct {
+	Chat            int `yaml:"chat"`
+	ChatBurst       int `yaml:"chat_burst"`
+	Connection      int `yaml:"connection"`
+	ConnectionBurst int `yaml:"connection_burst"`
+}
+
+// CircuitBreakerConfig struct
+type CircuitBreakerConfig struct {
+	Failures         int `yaml:"failures"`
+	OpenTimeout      int `yaml:"open_timeout"`
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+// CacheConfig struct
+type CacheConfig struct {
+	ReferenceTTL int `yaml:"reference_ttl"`
+	ProductSize  int `yaml:"product_size"`
+	ProductTTL   int `yaml:"product_ttl"`
+	StockTTL     int `yaml:"stock_ttl"`
+}
+
+// EncryptionConfig struct
+type EncryptionConfig struct {
+	Keys       map[string]string `yaml:"keys"`
+	CurrentKey string            `yaml:"current_key"`
+}
+
+// SessionConfig struct
+type SessionConfig struct {
+	Secret  string `yaml:"secret"`
+	LinkTTL int    `yaml:"link_ttl"`
+	TTL     int    `yaml:"ttl"`
+}
+
+// UninstallConfig struct
+type UninstallConfig struct {
+	Retention int `yaml:"retention"`
+}
+
+// TracingConfig struct
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
 // HTTPServerConfig struct
 type HTTPServerConfig struct {
 	Host   string `yaml:"host"`
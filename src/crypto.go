@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	encryptedPrefix  = "enc:v1:"
+	encryptionKeyEnv = "MG_BOT_ENCRYPTION_KEY"
+	dataKeySize      = 32
+)
+
+var keyRing *KeyRing
+
+// KeyRing encrypts secrets with envelope encryption: every value is sealed
+// with its own random data key, the data key is sealed with the current key
+// encryption key. Values sealed with older keys stay readable while their
+// keys are configured, rewrap moves them to the current key.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns key ring with keys from c, a key given in the
+// MG_BOT_ENCRYPTION_KEY environment variable as "id:base64" becomes current.
+// Without keys encryption is disabled and values are stored as is.
+func NewKeyRing(c EncryptionConfig) (*KeyRing, error) {
+	r := &KeyRing{current: c.CurrentKey, keys: map[string][]byte{}}
+
+	for id, encoded := range c.Keys {
+		if err := r.add(id, encoded); err != nil {
+			return nil, err
+		}
+	}
+
+	if env := os.Getenv(encryptionKeyEnv); env != "" {
+		parts := strings.SplitN(env, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s must be in id:base64 format", encryptionKeyEnv)
+		}
+		if err := r.add(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		r.current = parts[0]
+	}
+
+	if r.current == "" && len(r.keys) > 0 {
+		return nil, errors.New("encryption: current_key is not set")
+	}
+
+	if _, ok := r.keys[r.current]; r.current != "" && !ok {
+		return nil, fmt.Errorf("encryption: current key %s is not configured", r.current)
+	}
+
+	return r, nil
+}
+
+func (r *KeyRing) add(id, encoded string) error {
+	if id == "" || strings.Contains(id, ":") {
+		return fmt.Errorf("encryption: invalid key id %q", id)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("encryption: key %s: %v", id, err)
+	}
+
+	if len(key) != dataKeySize {
+		return fmt.Errorf("encryption: key %s must be 32 bytes long", id)
+	}
+
+	r.keys[id] = key
+
+	return nil
+}
+
+func (r *KeyRing) enabled() bool {
+	return r != nil && r.current != ""
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// keyID returns id of the key value is sealed with or empty string for plain values
+func keyID(value string) string {
+	if !isEncrypted(value) {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)[0]
+}
+
+// encrypt seals value with a new data key, empty values are kept as is
+func (r *KeyRing) encrypt(value string) (string, error) {
+	if !r.enabled() || value == "" || isEncrypted(value) {
+		return value, nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(r.keys[r.current], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(dataKey, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return r.format(wrapped, sealed), nil
+}
+
+// decrypt opens sealed value, plain values are returned as is
+func (r *KeyRing) decrypt(value string) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	id, wrapped, sealed, err := r.parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(r.keys[id], wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := open(dataKey, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// rewrap seals the data key of value with the current key, plain values are
+// encrypted. It reports whether value has been changed.
+func (r *KeyRing) rewrap(value string) (string, bool, error) {
+	if !r.enabled() || value == "" {
+		return value, false, nil
+	}
+
+	if !isEncrypted(value) {
+		encrypted, err := r.encrypt(value)
+		return encrypted, err == nil, err
+	}
+
+	id, wrapped, sealed, err := r.parse(value)
+	if err != nil || id == r.current {
+		return value, false, err
+	}
+
+	dataKey, err := open(r.keys[id], wrapped)
+	if err != nil {
+		return value, false, err
+	}
+
+	if wrapped, err = seal(r.keys[r.current], dataKey); err != nil {
+		return value, false, err
+	}
+
+	return r.format(wrapped, sealed), true, nil
+}
+
+func (r *KeyRing) format(wrapped, sealed []byte) string {
+	return encryptedPrefix + strings.Join([]string{
+		r.current,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(sealed),
+	}, ":")
+}
+
+func (r *KeyRing) parse(value string) (id string, wrapped, sealed []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("encryption: malformed value")
+	}
+
+	if r == nil || r.keys[parts[0]] == nil {
+		return "", nil, nil, fmt.Errorf("encryption: key %s is not configured", parts[0])
+	}
+
+	if wrapped, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return "", nil, nil, err
+	}
+
+	if sealed, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, err
+	}
+
+	return parts[0], wrapped, sealed, nil
+}
+
+// seal encrypts data with AES-GCM, the nonce is prepended to the result
+func seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encryption: malformed value")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
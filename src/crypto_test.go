@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), dataKeySize)))
+}
+
+func TestCrypto_encrypt(t *testing.T) {
+	r, err := NewKeyRing(EncryptionConfig{Keys: map[string]string{"k1": testKey('a')}, CurrentKey: "k1"})
+	assert.NoError(t, err)
+
+	encrypted, err := r.encrypt("secret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+"k1:"))
+	assert.NotContains(t, encrypted, "secret")
+
+	again, err := r.encrypt("secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, encrypted, again)
+
+	plain, err := r.decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", plain)
+
+	plain, err = r.decrypt("not encrypted")
+	assert.NoError(t, err)
+	assert.Equal(t, "not encrypted", plain)
+
+	_, err = r.decrypt(encrypted[:len(encrypted)-2])
+	assert.Error(t, err)
+}
+
+func TestCrypto_disabled(t *testing.T) {
+	r, err := NewKeyRing(EncryptionConfig{})
+	assert.NoError(t, err)
+	assert.False(t, r.enabled())
+
+	value, err := r.encrypt("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", value)
+
+	_, err = NewKeyRing(EncryptionConfig{Keys: map[string]string{"k1": testKey('a')}})
+	assert.Error(t, err)
+
+	_, err = NewKeyRing(EncryptionConfig{Keys: map[string]string{"k1": "c2hvcnQ="}, CurrentKey: "k1"})
+	assert.Error(t, err)
+}
+
+func TestCrypto_rewrap(t *testing.T) {
+	old, err := NewKeyRing(EncryptionConfig{Keys: map[string]string{"k1": testKey('a')}, CurrentKey: "k1"})
+	assert.NoError(t, err)
+
+	encrypted, err := old.encrypt("secret")
+	assert.NoError(t, err)
+
+	r, err := NewKeyRing(EncryptionConfig{
+		Keys:       map[string]string{"k1": testKey('a'), "k2": testKey('b')},
+		CurrentKey: "k2",
+	})
+	assert.NoError(t, err)
+
+	rewrapped, changed, err := r.rewrap(encrypted)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, strings.HasPrefix(rewrapped, encryptedPrefix+"k2:"))
+
+	_, changed, err = r.rewrap(rewrapped)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	rotated, err := NewKeyRing(EncryptionConfig{Keys: map[string]string{"k2": testKey('b')}, CurrentKey: "k2"})
+	assert.NoError(t, err)
+
+	plain, err := rotated.decrypt(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", plain)
+
+	_, err = rotated.decrypt(encrypted)
+	assert.Error(t, err)
+
+	sealed, changed, err := r.rewrap("plain")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, isEncrypted(sealed))
+}
+
+func TestCrypto_undecryptableConnection(t *testing.T) {
+	defer useSqlite(t)()
+	defer func(r *KeyRing) { keyRing = r }(keyRing)
+
+	var err error
+	keyRing, err = NewKeyRing(EncryptionConfig{Keys: map[string]string{"k1": testKey('a')}, CurrentKey: "k1"})
+	assert.NoError(t, err)
+
+	repo := NewGormConnectionRepository(orm)
+	err = repo.Create(&Connection{
+		ClientID: clientID,
+		APIKEY:   "key",
+		APIURL:   crmUrl,
+		MGURL:    "https://test.retailcrm.pro",
+		MGToken:  "token",
+		Active:   true,
+	})
+	assert.NoError(t, err)
+
+	keyRing, err = NewKeyRing(EncryptionConfig{Keys: map[string]string{"k2": testKey('b')}, CurrentKey: "k2"})
+	assert.NoError(t, err)
+
+	conn := repo.Get(clientID)
+	assert.Equal(t, clientID, conn.ClientID)
+	assert.Empty(t, conn.APIKEY, "ciphertext must not be used as api key")
+	assert.Empty(t, conn.MGToken, "ciphertext must not be used as mg token")
+	assert.Empty(t, repo.Active())
+
+	wm := NewWorkersManager(repo)
+	wm.setWorker(conn)
+	assert.Empty(t, wm.workers)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var dedup *Deduplicator
+
+// Deduplicator remembers processed messages so that events redelivered by MG
+// are not answered twice. Recent message IDs are kept in a bounded LRU, the
+// optional database table covers restarts and several instances.
+type Deduplicator struct {
+	mutex      sync.Mutex
+	size       int
+	items      *list.List
+	index      map[string]*list.Element
+	persistent bool
+	ttl        time.Duration
+}
+
+// NewDeduplicator returns deduplicator configured by c
+func NewDeduplicator(c DedupConfig) *Deduplicator {
+	size := c.CacheSize
+	if size <= 0 {
+		size = 10000
+	}
+
+	ttl := time.Duration(c.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	return &Deduplicator{
+		size:       size,
+		items:      list.New(),
+		index:      make(map[string]*list.Element, size),
+		persistent: c.Persistent,
+		ttl:        ttl,
+	}
+}
+
+// seen records the message and reports whether it was already processed
+func (d *Deduplicator) seen(clientID string, messageID uint64) bool {
+	key := fmt.Sprintf("%s:%d", clientID, messageID)
+
+	d.mutex.Lock()
+	if el, ok := d.index[key]; ok {
+		d.items.MoveToFront(el)
+		d.mutex.Unlock()
+		return true
+	}
+
+	d.index[key] = d.items.PushFront(key)
+	if d.items.Len() > d.size {
+		el := d.items.Back()
+		d.items.Remove(el)
+		delete(d.index, el.Value.(string))
+	}
+	d.mutex.Unlock()
+
+	if !d.persistent {
+		return false
+	}
+
+	ok, err := markMessageProcessed(clientID, messageID, time.Now())
+	if err != nil {
+		logger.Errorf("dedup: mark message %s: %v", key, err)
+		return false
+	}
+
+	return !ok
+}
+
+// purge periodically removes persisted messages older than ttl
+func (d *Deduplicator) purge() {
+	if !d.persistent {
+		return
+	}
+
+	for {
+		if err := deleteProcessedMessages(time.Now().Add(-d.ttl)); err != nil {
+			logger.Errorf("dedup: purge: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator_seen(t *testing.T) {
+	d := NewDeduplicator(DedupConfig{CacheSize: 2})
+
+	assert.False(t, d.seen(clientID, 1))
+	assert.True(t, d.seen(clientID, 1), "redelivered message must be skipped")
+	assert.False(t, d.seen("other", 1), "same message id of another connection must be processed")
+
+	d.seen(clientID, 2)
+	assert.False(t, d.seen(clientID, 1), "evicted message must be processed")
+}
+
+func TestDeduplicator_persistent(t *testing.T) {
+	requireDB(t)
+
+	defer orm.DB.Delete(ProcessedMessage{}, "client_id = ?", clientID)
+
+	a := NewDeduplicator(DedupConfig{Persistent: true})
+	b := NewDeduplicator(DedupConfig{Persistent: true})
+
+	assert.False(t, a.seen(clientID, 10))
+	assert.True(t, b.seen(clientID, 10), "message processed by another instance must be skipped")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func init() {
+	parser.AddCommand("encrypt",
+		"Encrypt connection secrets with the current key",
+		"Encrypt API keys and MG tokens stored in plain text and rewrap values sealed with previous keys. "+
+			"To rotate the key add a new one to encryption.keys, set it as current_key and run this command.",
+		&EncryptCommand{},
+	)
+}
+
+// EncryptCommand struct
+type EncryptCommand struct{}
+
+// Execute method
+func (x *EncryptCommand) Execute(args []string) error {
+	config = LoadConfig(options.Config)
+	orm = NewDb(config)
+	logger = newLogger()
+	defer orm.DB.Close()
+
+	var err error
+	if keyRing, err = NewKeyRing(config.Encryption); err != nil {
+		return err
+	}
+
+	if !keyRing.enabled() {
+		return errors.New("encryption key is not configured")
+	}
+
+	count, err := NewGormConnectionRepository(orm).Encrypt()
+	fmt.Printf("Encrypted %d connections\n", count)
+
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/retailcrm/api-client-go/errs"
+)
+
+const (
+	ErrorClassAuth        = "auth"
+	ErrorClassNotFound    = "not_found"
+	ErrorClassRateLimited = "rate_limited"
+	ErrorClassTransient   = "transient"
+	ErrorClassValidation  = "validation"
+)
+
+const (
+	ServiceCRM = "crm"
+	ServiceMG  = "mg"
+)
+
+// APIError is an error of CRM or MG request classified by its cause
+type APIError struct {
+	Service string
+	Class   string
+	Status  int
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s error, status %d: %v", e.Service, e.Class, e.Status, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// classifyStatus returns class of the error by status of the response,
+// zero status means that the request has not reached the service
+func classifyStatus(status int) string {
+	switch {
+	case status == 0 || status >= http.StatusInternalServerError:
+		return ErrorClassTransient
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorClassAuth
+	case status == http.StatusNotFound:
+		return ErrorClassNotFound
+	case status == http.StatusTooManyRequests:
+		return ErrorClassRateLimited
+	default:
+		return ErrorClassValidation
+	}
+}
+
+// newCRMError returns classified error of CRM request or nil if it succeeded
+func newCRMError(status int, failure errs.Failure) error {
+	if failure.RuntimeErr != nil {
+		return &APIError{Service: ServiceCRM, Class: ErrorClassTransient, Status: status, Err: failure.RuntimeErr}
+	}
+
+	if failure.ApiErr != "" {
+		return &APIError{Service: ServiceCRM, Class: classifyStatus(status), Status: status, Err: errors.New(failure.ApiErr)}
+	}
+
+	return nil
+}
+
+// newMGError returns classified error of MG request or nil if it succeeded
+func newMGError(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &APIError{Service: ServiceMG, Class: classifyStatus(status), Status: status, Err: err}
+}
+
+// errorClass returns class of err or empty string for unclassified errors
+func errorClass(err error) string {
+	if err == errBreakerOpen {
+		return ErrorClassTransient
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Class
+	}
+
+	return ""
+}
+
+// errorReply returns the message answered to the chat on err and whether
+// err should be reported to Sentry
+func errorReply(err error) (messageID string, report bool) {
+	switch errorClass(err) {
+	case ErrorClassAuth:
+		return "service_unavailable", false
+	case ErrorClassNotFound:
+		return "not_found", false
+	case ErrorClassRateLimited:
+		return "too_many_requests", false
+	case ErrorClassTransient:
+		return "service_unavailable", err != errBreakerOpen
+	case ErrorClassValidation:
+		return "wrong_data", true
+	}
+
+	return "service_unavailable", true
+}
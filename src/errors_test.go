@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/retailcrm/api-client-go/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors_newCRMError(t *testing.T) {
+	cases := []struct {
+		status  int
+		failure errs.Failure
+		class   string
+	}{
+		{0, errs.Failure{RuntimeErr: errors.New("connection refused")}, ErrorClassTransient},
+		{http.StatusForbidden, errs.Failure{ApiErr: "Wrong \"apiKey\" value."}, ErrorClassAuth},
+		{http.StatusUnauthorized, errs.Failure{ApiErr: "Unauthorized"}, ErrorClassAuth},
+		{http.StatusNotFound, errs.Failure{ApiErr: "Not found"}, ErrorClassNotFound},
+		{http.StatusTooManyRequests, errs.Failure{ApiErr: "Too many requests"}, ErrorClassRateLimited},
+		{http.StatusBadRequest, errs.Failure{ApiErr: "Errors in the input parameters"}, ErrorClassValidation},
+		{http.StatusBadGateway, errs.Failure{ApiErr: "Bad gateway"}, ErrorClassTransient},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.class, errorClass(newCRMError(c.status, c.failure)), c.failure)
+	}
+
+	assert.Nil(t, newCRMError(http.StatusOK, errs.Failure{}))
+}
+
+func TestErrors_errorReply(t *testing.T) {
+	cases := []struct {
+		err       error
+		messageID string
+		report    bool
+	}{
+		{newCRMError(http.StatusForbidden, errs.Failure{ApiErr: "Forbidden"}), "service_unavailable", false},
+		{newCRMError(http.StatusNotFound, errs.Failure{ApiErr: "Not found"}), "not_found", false},
+		{newCRMError(http.StatusTooManyRequests, errs.Failure{ApiErr: "Too many requests"}), "too_many_requests", false},
+		{newCRMError(http.StatusServiceUnavailable, errs.Failure{ApiErr: "Unavailable"}), "service_unavailable", true},
+		{newCRMError(http.StatusBadRequest, errs.Failure{ApiErr: "Bad request"}), "wrong_data", true},
+		{errBreakerOpen, "service_unavailable", false},
+		{errors.New("unexpected"), "service_unavailable", true},
+	}
+
+	for _, c := range cases {
+		messageID, report := errorReply(c.err)
+		assert.Equal(t, c.messageID, messageID, c.err.Error())
+		assert.Equal(t, c.report, report, c.err.Error())
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"html/template"
-	"io/ioutil"
+	"io/fs"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"golang.org/x/text/language"
@@ -21,17 +21,27 @@ var (
 
 func loadTranslateFile() {
 	bundle.RegisterUnmarshalFunc("yml", yaml.Unmarshal)
-	files, err := ioutil.ReadDir("translate")
+	files, err := fs.ReadDir(assets, "translate")
 	if err != nil {
 		panic(err)
 	}
 	for _, f := range files {
 		if !f.IsDir() {
-			bundle.MustLoadMessageFile("translate/" + f.Name())
+			buf, err := fs.ReadFile(assets, "translate/"+f.Name())
+			if err != nil {
+				panic(err)
+			}
+			bundle.MustParseMessageFileBytes(buf, f.Name())
 		}
 	}
 }
 
+// translationsLoaded reports whether messages of the default language are available
+func translationsLoaded() bool {
+	_, err := i18n.NewLocalizer(bundle, language.English.String()).Localize(&i18n.LocalizeConfig{MessageID: "language"})
+	return err == nil
+}
+
 func setLocale(al string) {
 	tag, _ := language.MatchStrings(matcher, al)
 	localizer = i18n.NewLocalizer(bundle, tag.String())
@@ -52,6 +62,10 @@ func getLocale() map[string]interface{} {
 		"TableActivity": getLocalizedMessage("table_activity"),
 		"Title":         getLocalizedMessage("title"),
 		"Language":      getLocalizedMessage("language"),
+		"RealtimeStock": getLocalizedMessage("realtime_stock"),
+		"Broken":        getLocalizedMessage("connection_broken"),
+		"Uninstall":     getLocalizedMessage("button_uninstall"),
+		"UninstallHint": getLocalizedMessage("uninstall_confirm"),
 		"CRMLink":       template.HTML(getLocalizedMessage("crm_link")),
 		"DocLink":       template.HTML(getLocalizedMessage("doc_link")),
 	}
@@ -1,22 +1,273 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/op/go-logging"
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	redactedValue = "***"
+
+	// minSecretLength keeps ordinary words from being masked, API keys and
+	// bot tokens are much longer
+	minSecretLength = 16
+	// maxSecrets bounds the registered secrets, values beyond it are still
+	// masked in key and token parameters
+	maxSecrets = 10000
+)
+
 var logFormat = logging.MustStringFormatter(
 	`%{time:2006-01-02 15:04:05.000} %{level:.4s} => %{message}`,
 )
 
+var (
+	secretsMutex    sync.RWMutex
+	secrets         = map[string]int{}
+	secretsReplacer = strings.NewReplacer()
+	secretParams    = regexp.MustCompile(`(?i)((?:api[_-]?key|token|x-api-key|x-bot-token)["']?\s*[:=]\s*["']?)[^\s"'&,}]+`)
+)
+
+// LogFields are attached to a log record, rendered as key=value pairs in text
+// format and as object keys in json format.
+type LogFields map[string]interface{}
+
+// FieldLogger writes records with fields to the logger
+type FieldLogger struct {
+	logger *logging.Logger
+	fields LogFields
+}
+
+type logEntry struct {
+	message string
+	fields  LogFields
+}
+
+func (e logEntry) String() string {
+	if len(e.fields) == 0 {
+		return e.message
+	}
+
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(e.message)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, e.fields[key])
+	}
+
+	return b.String()
+}
+
 func newLogger() *logging.Logger {
 	logger := logging.MustGetLogger(config.BotInfo.Code)
-	logBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	formatBackend := logging.NewBackendFormatter(logBackend, logFormat)
-	backend1Leveled := logging.AddModuleLevel(logBackend)
-	backend1Leveled.SetLevel(config.LogLevel, "")
-	logging.SetBackend(formatBackend)
+
+	var backend logging.Backend = logging.NewBackendFormatter(logging.NewLogBackend(os.Stdout, "", 0), logFormat)
+	if config.LogFormat == LogFormatJSON {
+		backend = &jsonBackend{out: os.Stdout}
+	}
+
+	leveled := logging.SetBackend(&redactBackend{backend: backend})
+	leveled.SetLevel(config.LogLevel, "")
+
+	log.SetOutput(&redactWriter{out: os.Stderr})
 
 	return logger
 }
+
+// setLogLevel changes the level of the running logger
+func setLogLevel(level logging.Level) {
+	logging.SetLevel(level, "")
+}
+
+func getLogLevel() logging.Level {
+	return logging.GetLevel("")
+}
+
+func withFields(logger *logging.Logger, fields LogFields) *FieldLogger {
+	return &FieldLogger{logger: logger, fields: fields}
+}
+
+// With returns logger with fields added to the fields of l
+func (l *FieldLogger) With(fields LogFields) *FieldLogger {
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &FieldLogger{logger: l.logger, fields: merged}
+}
+
+func (l *FieldLogger) entry(format string, args ...interface{}) logEntry {
+	return logEntry{message: fmt.Sprintf(format, args...), fields: l.fields}
+}
+
+func (l *FieldLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(l.entry(format, args...))
+}
+
+func (l *FieldLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(l.entry(format, args...))
+}
+
+func (l *FieldLogger) Warningf(format string, args ...interface{}) {
+	l.logger.Warning(l.entry(format, args...))
+}
+
+func (l *FieldLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(l.entry(format, args...))
+}
+
+// registerSecret makes the logger mask every occurrence of s until it is
+// unregistered as many times as it was registered
+func registerSecret(s string) {
+	if len(s) < minSecretLength {
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	if _, ok := secrets[s]; !ok && len(secrets) >= maxSecrets {
+		return
+	}
+
+	secrets[s]++
+	if secrets[s] == 1 {
+		updateSecretsReplacer()
+	}
+}
+
+// unregisterSecret releases s registered by registerSecret
+func unregisterSecret(s string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	if _, ok := secrets[s]; !ok {
+		return
+	}
+
+	secrets[s]--
+	if secrets[s] == 0 {
+		delete(secrets, s)
+		updateSecretsReplacer()
+	}
+}
+
+// updateSecretsReplacer rebuilds the replacer masking all the secrets in one
+// pass, secretsMutex must be held
+func updateSecretsReplacer() {
+	pairs := make([]string, 0, 2*len(secrets))
+	for secret := range secrets {
+		pairs = append(pairs, secret, redactedValue)
+	}
+
+	secretsReplacer = strings.NewReplacer(pairs...)
+}
+
+// redact masks registered secrets and values of key and token parameters
+func redact(s string) string {
+	secretsMutex.RLock()
+	replacer := secretsReplacer
+	secretsMutex.RUnlock()
+
+	return secretParams.ReplaceAllString(replacer.Replace(s), "${1}"+redactedValue)
+}
+
+// redactBackend replaces the record by its redacted copy before passing it on
+type redactBackend struct {
+	backend logging.Backend
+}
+
+func (b *redactBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := recordEntry(rec)
+
+	redacted := logEntry{message: redact(entry.message)}
+	if len(entry.fields) > 0 {
+		redacted.fields = make(LogFields, len(entry.fields))
+		for key, value := range entry.fields {
+			redacted.fields[key] = redact(fmt.Sprint(value))
+		}
+	}
+
+	return b.backend.Log(level, calldepth+1, &logging.Record{
+		ID:     rec.ID,
+		Time:   rec.Time,
+		Module: rec.Module,
+		Level:  rec.Level,
+		Args:   []interface{}{redacted},
+	})
+}
+
+// jsonBackend writes records as json objects, one per line
+type jsonBackend struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := recordEntry(rec)
+
+	data := make(map[string]interface{}, len(entry.fields)+4)
+	for key, value := range entry.fields {
+		data[key] = value
+	}
+	data["time"] = rec.Time.Format("2006-01-02T15:04:05.000Z07:00")
+	data["level"] = level.String()
+	data["module"] = rec.Module
+	data["message"] = entry.message
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, err = b.out.Write(append(line, '\n'))
+	return err
+}
+
+// recordEntry returns message and fields of the record
+func recordEntry(rec *logging.Record) logEntry {
+	if len(rec.Args) == 1 {
+		if e, ok := rec.Args[0].(logEntry); ok {
+			return e
+		}
+	}
+
+	return logEntry{message: rec.Message()}
+}
+
+// redactWriter masks secrets written by the standard logger, e.g. debug
+// output of the API clients
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write([]byte(redact(string(p)))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func secretRegistered(s string) bool {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+
+	_, ok := secrets[s]
+	return ok
+}
+
+func TestLog_redact(t *testing.T) {
+	registerSecret("secret-mg-token-value")
+	defer unregisterSecret("secret-mg-token-value")
+
+	assert.Equal(t, "token: ***", redact("token: secret-mg-token-value"))
+	assert.Equal(t, "https://demo.retailcrm.ru?apiKey=***&limit=20", redact("https://demo.retailcrm.ru?apiKey=abcdef&limit=20"))
+	assert.Equal(t, `{"X-API-KEY":"***"}`, redact(`{"X-API-KEY":"abcdef"}`))
+	assert.Equal(t, "no secrets here", redact("no secrets here"))
+}
+
+func TestLog_unregisterSecret(t *testing.T) {
+	registerSecret("test")
+	assert.Equal(t, "testing worker_test.go", redact("testing worker_test.go"), "short values must not be masked")
+
+	registerSecret("rotated-api-key-value")
+	registerSecret("rotated-api-key-value")
+	assert.Equal(t, "key ***", redact("key rotated-api-key-value"))
+
+	unregisterSecret("rotated-api-key-value")
+	assert.Equal(t, "key ***", redact("key rotated-api-key-value"), "secret is still used")
+
+	unregisterSecret("rotated-api-key-value")
+	assert.Equal(t, "key rotated-api-key-value", redact("key rotated-api-key-value"))
+	assert.False(t, secretRegistered("rotated-api-key-value"))
+}
+
+func TestLog_jsonFields(t *testing.T) {
+	var buf bytes.Buffer
+	registerSecret("secret-api-key-value")
+	defer unregisterSecret("secret-api-key-value")
+
+	backend := logging.AddModuleLevel(&redactBackend{backend: &jsonBackend{out: &buf}})
+	backend.SetLevel(logging.DEBUG, "")
+
+	l := logging.MustGetLogger("log-test")
+	l.SetBackend(backend)
+	logging.SetLevel(logging.DEBUG, "log-test")
+
+	withFields(l, LogFields{"client_id": "clientID"}).
+		With(LogFields{"chat_id": 1}).
+		Errorf("request with secret-api-key-value failed")
+
+	var data map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &data))
+	assert.Equal(t, "request with *** failed", data["message"])
+	assert.Equal(t, "ERROR", data["level"])
+	assert.Equal(t, "clientID", data["client_id"])
+	assert.Equal(t, "1", data["chat_id"])
+}
+
+func TestLog_textFields(t *testing.T) {
+	entry := logEntry{message: "start ws", fields: LogFields{"crm_url": "https://demo.retailcrm.ru", "client_id": "clientID"}}
+
+	assert.Equal(t, "start ws client_id=clientID crm_url=https://demo.retailcrm.ru", entry.String())
+}
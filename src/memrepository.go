@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryConnectionRepository keeps connections in memory, it is used in
+// tests of handlers and workers
+type MemoryConnectionRepository struct {
+	mutex       sync.RWMutex
+	connections map[string]*Connection
+	audit       []*AuditRecord
+	lastID      int
+}
+
+// NewMemoryConnectionRepository returns empty repository
+func NewMemoryConnectionRepository() *MemoryConnectionRepository {
+	return &MemoryConnectionRepository{connections: map[string]*Connection{}}
+}
+
+// find returns copy of the first connection matching fn
+func (r *MemoryConnectionRepository) find(fn func(c *Connection) bool) *Connection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, c := range r.connections {
+		if fn(c) {
+			connection := *c
+			return &connection
+		}
+	}
+
+	return &Connection{}
+}
+
+func (r *MemoryConnectionRepository) Get(clientID string) *Connection {
+	return r.find(func(c *Connection) bool {
+		return c.ClientID == clientID && c.DeletedAt == nil
+	})
+}
+
+func (r *MemoryConnectionRepository) GetByURL(apiURL string) *Connection {
+	return r.find(func(c *Connection) bool {
+		return c.APIURL == apiURL && c.DeletedAt == nil
+	})
+}
+
+func (r *MemoryConnectionRepository) GetDeleted(clientID string) *Connection {
+	return r.find(func(c *Connection) bool {
+		return c.ClientID == clientID && c.DeletedAt != nil
+	})
+}
+
+func (r *MemoryConnectionRepository) GetDeletedByURL(apiURL string) *Connection {
+	return r.find(func(c *Connection) bool {
+		return c.APIURL == apiURL && c.DeletedAt != nil
+	})
+}
+
+func (r *MemoryConnectionRepository) Active() []*Connection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var connections []*Connection
+	for _, c := range r.connections {
+		if c.Active && c.DeletedAt == nil {
+			connection := *c
+			connections = append(connections, &connection)
+		}
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+
+	return connections
+}
+
+func (r *MemoryConnectionRepository) Create(c *Connection) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastID++
+	c.ID = r.lastID
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+
+	connection := *c
+	r.connections[c.ClientID] = &connection
+
+	return nil
+}
+
+// Save updates non-zero fields of the connection like gorm does
+func (r *MemoryConnectionRepository) Save(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		src := reflect.ValueOf(c).Elem()
+		dst := reflect.ValueOf(stored).Elem()
+
+		for i := 0; i < src.NumField(); i++ {
+			if name := src.Type().Field(i).Name; name == "ID" || name == "CreatedAt" {
+				continue
+			}
+
+			if field := src.Field(i); !reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+				dst.Field(i).Set(field)
+			}
+		}
+	})
+}
+
+// update applies fn to the stored connection which is not deleted
+func (r *MemoryConnectionRepository) update(c *Connection, fn func(stored *Connection)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if stored, ok := r.connections[c.ClientID]; ok && stored.DeletedAt == nil {
+		fn(stored)
+		stored.UpdatedAt = time.Now()
+	}
+
+	return nil
+}
+
+func (r *MemoryConnectionRepository) SetActivity(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		stored.Active = c.Active
+		stored.APIURL = c.APIURL
+	})
+}
+
+func (r *MemoryConnectionRepository) SetBotSettings(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		stored.Lang = c.Lang
+		stored.Currency = c.Currency
+		stored.RealtimeStock = c.RealtimeStock
+	})
+}
+
+func (r *MemoryConnectionRepository) SetRateLimit(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		stored.ChatRateLimit = c.ChatRateLimit
+		stored.ConnectionRateLimit = c.ConnectionRateLimit
+	})
+}
+
+func (r *MemoryConnectionRepository) SetBroken(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		stored.Broken = c.Broken
+	})
+}
+
+func (r *MemoryConnectionRepository) Delete(c *Connection) error {
+	return r.update(c, func(stored *Connection) {
+		now := time.Now()
+		stored.DeletedAt = &now
+	})
+}
+
+func (r *MemoryConnectionRepository) Restore(c *Connection) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if stored, ok := r.connections[c.ClientID]; ok {
+		stored.DeletedAt = nil
+	}
+
+	return nil
+}
+
+func (r *MemoryConnectionRepository) Purge(clientID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if stored, ok := r.connections[clientID]; ok && stored.DeletedAt != nil {
+		delete(r.connections, clientID)
+	}
+
+	return nil
+}
+
+func (r *MemoryConnectionRepository) PurgeDeleted(before time.Time) (count int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for clientID, c := range r.connections {
+		if c.DeletedAt != nil && c.DeletedAt.Before(before) {
+			delete(r.connections, clientID)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (r *MemoryConnectionRepository) AddAudit(record *AuditRecord) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record.ID = len(r.audit) + 1
+	record.CreatedAt = time.Now()
+	r.audit = append(r.audit, record)
+
+	return nil
+}
+
+func (r *MemoryConnectionRepository) Audit(clientID string, limit int) []*AuditRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var records []*AuditRecord
+	for i := len(r.audit) - 1; i >= 0 && len(records) < limit; i-- {
+		if r.audit[i].ClientID == clientID {
+			records = append(records, r.audit[i])
+		}
+	}
+
+	return records
+}
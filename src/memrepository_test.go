@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryConnectionRepository_save(t *testing.T) {
+	repo := NewMemoryConnectionRepository()
+	repo.Create(&Connection{ClientID: clientID, APIURL: crmUrl, APIKEY: "key", Lang: "ru", Active: true})
+
+	assert.NoError(t, repo.Save(&Connection{ClientID: clientID, APIKEY: "new"}))
+
+	conn := repo.Get(clientID)
+	assert.Equal(t, 1, conn.ID)
+	assert.Equal(t, "new", conn.APIKEY)
+	assert.Equal(t, crmUrl, conn.APIURL)
+	assert.Equal(t, "ru", conn.Lang)
+	assert.True(t, conn.Active)
+
+	conn.Lang = "en"
+	assert.Equal(t, "ru", repo.Get(clientID).Lang)
+	assert.Equal(t, 0, repo.Get("unknown").ID)
+}
+
+func TestMemoryConnectionRepository_delete(t *testing.T) {
+	repo := NewMemoryConnectionRepository()
+	conn := &Connection{ClientID: clientID, APIURL: crmUrl, Active: true}
+	repo.Create(conn)
+
+	assert.NoError(t, repo.Delete(conn))
+	assert.Equal(t, 0, repo.Get(clientID).ID)
+	assert.Empty(t, repo.Active())
+	assert.NotEqual(t, 0, repo.GetDeletedByURL(crmUrl).ID)
+
+	assert.NoError(t, repo.Restore(conn))
+	assert.NotEqual(t, 0, repo.Get(clientID).ID)
+
+	repo.Delete(conn)
+	count, err := repo.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = repo.PurgeDeleted(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 0, repo.GetDeleted(clientID).ID)
+}
+
+func TestMemoryConnectionRepository_audit(t *testing.T) {
+	repo := NewMemoryConnectionRepository()
+	repo.AddAudit(&AuditRecord{ClientID: clientID, Action: "create"})
+	repo.AddAudit(&AuditRecord{ClientID: "another", Action: "create"})
+	repo.AddAudit(&AuditRecord{ClientID: clientID, Action: "save"})
+
+	records := repo.Audit(clientID, 10)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "save", records[0].Action)
+		assert.Equal(t, "create", records[1].Action)
+	}
+
+	assert.Len(t, repo.Audit(clientID, 1), 1)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are labeled by command and API method only, connection data such
+// as CRM URLs, client IDs and keys never becomes a label.
+var (
+	commandsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mg_bot_commands_total",
+			Help: "Bot commands executed by name and outcome.",
+		},
+		[]string{"command", "outcome"},
+	)
+	crmRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mg_bot_crm_request_duration_seconds",
+			Help:    "CRM API request latency by method and outcome.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method", "outcome"},
+	)
+	mgRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mg_bot_mg_request_duration_seconds",
+			Help:    "MG API request latency by method and outcome.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method", "outcome"},
+	)
+	wsReconnectsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mg_bot_ws_reconnects_total",
+			Help: "WebSocket reconnections to MG.",
+		},
+	)
+	messageSendFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mg_bot_message_send_failures_total",
+			Help: "Failed deliveries of replies by result: retry, dead or enqueue.",
+		},
+		[]string{"result"},
+	)
+	activeWorkers = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "mg_bot_active_workers",
+			Help: "Workers running in the instance.",
+		},
+		func() float64 {
+			return float64(wm.size())
+		},
+	)
+	productCacheHits = prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "mg_bot_product_cache_hits_total",
+			Help: "Product searches answered from the cache.",
+		},
+		func() float64 {
+			return float64(products.stats().Hits)
+		},
+	)
+	productCacheMisses = prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "mg_bot_product_cache_misses_total",
+			Help: "Product searches missed in the cache.",
+		},
+		func() float64 {
+			return float64(products.stats().Misses)
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		commandsTotal,
+		crmRequestDuration,
+		mgRequestDuration,
+		wsReconnectsTotal,
+		messageSendFailuresTotal,
+		activeWorkers,
+		productCacheHits,
+		productCacheMisses,
+	)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+func observeDuration(h *prometheus.HistogramVec, method string, start time.Time, err error) {
+	h.WithLabelValues(method, outcome(err)).Observe(time.Since(start).Seconds())
+}
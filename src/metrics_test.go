@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// sampleCount returns number of observations of the histogram
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetrics_handler(t *testing.T) {
+	commandsTotal.WithLabelValues("payment", "success").Inc()
+
+	failed := crmRequestDuration.WithLabelValues("payment_types", "error")
+	before := sampleCount(t, failed)
+	observeDuration(crmRequestDuration, "payment_types", time.Now(), errors.New("timeout"))
+	assert.Equal(t, before+1, sampleCount(t, failed))
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `mg_bot_commands_total{command="payment",outcome="success"}`)
+	assert.Contains(t, rr.Body.String(), `mg_bot_crm_request_duration_seconds_count{method="payment_types",outcome="error"}`)
+	assert.Contains(t, rr.Body.String(), "mg_bot_active_workers")
+	assert.Contains(t, rr.Body.String(), "mg_bot_product_cache_hits_total")
+}
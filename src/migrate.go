@@ -1,32 +1,73 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"text/template"
+	"time"
 
 	"github.com/golang-migrate/migrate"
+	"github.com/golang-migrate/migrate/database/postgres"
+	"github.com/golang-migrate/migrate/database/sqlite3"
+	"github.com/golang-migrate/migrate/source"
 )
 
+var regMigrationName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
 func init() {
-	parser.AddCommand("migrate",
+	migrateCommand := &MigrateCommand{}
+	cmd, err := parser.AddCommand("migrate",
 		"Migrate database to defined migrations version",
 		"Migrate database to defined migrations version.",
-		&MigrateCommand{},
+		migrateCommand,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	cmd.SubcommandsOptional = true
+	cmd.AddCommand("status",
+		"Show migrations status",
+		"Show current version of the database, dirty flag and pending migrations.",
+		&MigrateStatusCommand{migrate: migrateCommand},
+	)
+	cmd.AddCommand("force",
+		"Force migrations version",
+		"Set migrations version without running migrations and reset the dirty flag. "+
+			"Use it after fixing the database manually when a migration has failed, \"force -- -1\" removes the version.",
+		&MigrateForceCommand{migrate: migrateCommand},
+	)
+	cmd.AddCommand("create",
+		"Create migration files",
+		"Create empty up and down migrations named <timestamp>_<name> in the migrations path and its sqlite3 subdirectory.",
+		&MigrateCreateCommand{migrate: migrateCommand},
 	)
 }
 
 // MigrateCommand struct
 type MigrateCommand struct {
 	Version string `short:"v" long:"version" default:"up" description:"Migrate to defined migrations version. Allowed: up, down, next, prev and integer value."`
-	Path    string `short:"p" long:"path" default:"" description:"Path to migrations files."`
+	Path    string `short:"p" long:"path" default:"" description:"Path to migrations files, embedded migrations are used by default."`
 }
 
 // Execute method
 func (x *MigrateCommand) Execute(args []string) error {
 	botConfig := LoadConfig(options.Config)
 
-	err := Migrate(botConfig.Database.Connection, x.Version, x.Path)
+	migrations, err := x.migrations(botConfig)
+	if err != nil {
+		return err
+	}
+
+	err = Migrate(botConfig.Database, x.Version, migrations)
 	if err != nil && err.Error() == "no change" {
 		fmt.Println("No changes detected. Skipping migration.")
 		err = nil
@@ -35,11 +76,321 @@ func (x *MigrateCommand) Execute(args []string) error {
 	return err
 }
 
+// migrations returns migrations of the path option or embedded ones
+func (x *MigrateCommand) migrations(c *BotConfig) (fs.FS, error) {
+	if x.Path != "" {
+		return os.DirFS(x.Path), nil
+	}
+
+	return fs.Sub(newAssets(c.AssetsDir), "migrations")
+}
+
+// MigrateStatusCommand struct
+type MigrateStatusCommand struct {
+	migrate *MigrateCommand
+}
+
+// Execute method
+func (x *MigrateStatusCommand) Execute(args []string) error {
+	botConfig := LoadConfig(options.Config)
+
+	migrations, err := x.migrate.migrations(botConfig)
+	if err != nil {
+		return err
+	}
+
+	m, src, err := newMigrate(botConfig.Database, migrations)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	version, dirty, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return err
+	}
+
+	if err == migrate.ErrNilVersion {
+		fmt.Println("Current version: none")
+	} else {
+		fmt.Printf("Current version: %d\n", version)
+	}
+	fmt.Printf("Dirty: %t\n", dirty)
+
+	pending := src.pending(version, err == migrate.ErrNilVersion)
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+		return nil
+	}
+
+	fmt.Println("Pending migrations:")
+	for _, name := range pending {
+		fmt.Println("  " + name)
+	}
+
+	return nil
+}
+
+// MigrateForceCommand struct
+type MigrateForceCommand struct {
+	migrate *MigrateCommand
+	Args    struct {
+		Version int `positional-arg-name:"version" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// Execute method
+func (x *MigrateForceCommand) Execute(args []string) error {
+	botConfig := LoadConfig(options.Config)
+
+	migrations, err := x.migrate.migrations(botConfig)
+	if err != nil {
+		return err
+	}
+
+	m, _, err := newMigrate(botConfig.Database, migrations)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Force(x.Args.Version); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrations version is forced to %d\n", x.Args.Version)
+
+	return nil
+}
+
+// MigrateCreateCommand struct
+type MigrateCreateCommand struct {
+	migrate *MigrateCommand
+	Args    struct {
+		Name string `positional-arg-name:"name" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// Execute method
+func (x *MigrateCreateCommand) Execute(args []string) error {
+	path := x.migrate.Path
+	if path == "" {
+		path = "migrations"
+	}
+
+	files, err := createMigration(path, x.Args.Name, time.Now())
+	for _, f := range files {
+		fmt.Println("Created " + f)
+	}
+
+	return err
+}
+
+// createMigration creates empty up and down files of the migration in path and
+// its sqlite3 subdirectory. Version is the unix time of now or the next one
+// after the latest migration, so the new migration always runs last.
+func createMigration(path string, name string, now time.Time) (created []string, err error) {
+	if !regMigrationName.MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name %q, use lowercase letters, digits and underscores", name)
+	}
+
+	dirs := []string{path}
+	if stat, err := os.Stat(filepath.Join(path, dialectSqlite)); err == nil && stat.IsDir() {
+		dirs = append(dirs, filepath.Join(path, dialectSqlite))
+	}
+
+	version := uint(now.Unix())
+	for _, dir := range dirs {
+		src, err := newMigrationsSource(os.DirFS(dir), "")
+		if err != nil {
+			return nil, err
+		}
+
+		if last, ok := src.last(); ok && last >= version {
+			version = last + 1
+		}
+	}
+
+	for _, dir := range dirs {
+		for _, direction := range []source.Direction{source.Up, source.Down} {
+			file := filepath.Join(dir, fmt.Sprintf("%d_%s.%s.sql", version, name, direction))
+
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return created, err
+			}
+			f.Close()
+
+			created = append(created, file)
+		}
+	}
+
+	return created, nil
+}
+
+// migrationsSource reads migrations from fs.FS rendering {{.Prefix}} with the
+// table prefix
+type migrationsSource struct {
+	fs         fs.FS
+	migrations *source.Migrations
+	Prefix     string
+}
+
+func newMigrationsSource(fsys fs.FS, prefix string) (*migrationsSource, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &migrationsSource{fs: fsys, migrations: source.NewMigrations(), Prefix: prefix}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		m, err := source.DefaultParse(f.Name())
+		if err != nil {
+			continue
+		}
+
+		if !s.migrations.Append(m) {
+			return nil, fmt.Errorf("unable to parse file %s", f.Name())
+		}
+	}
+
+	return s, nil
+}
+
+// last returns version of the latest migration
+func (s *migrationsSource) last() (version uint, ok bool) {
+	for v, found := s.migrations.First(); found; v, found = s.migrations.Next(v) {
+		version, ok = v, true
+	}
+
+	return
+}
+
+// pending returns files of migrations after the version, all of them when
+// the database has no version
+func (s *migrationsSource) pending(version uint, none bool) (files []string) {
+	next, ok := s.migrations.Next(version)
+	if none {
+		next, ok = s.migrations.First()
+	}
+
+	for ; ok; next, ok = s.migrations.Next(next) {
+		if m, found := s.migrations.Up(next); found {
+			files = append(files, m.Raw)
+		}
+	}
+
+	return
+}
+
+func (s *migrationsSource) Open(url string) (source.Driver, error) {
+	return nil, errors.New("migrations source is created with newMigrationsSource")
+}
+
+func (s *migrationsSource) Close() error {
+	return nil
+}
+
+func (s *migrationsSource) First() (uint, error) {
+	if version, ok := s.migrations.First(); ok {
+		return version, nil
+	}
+
+	return 0, &os.PathError{Op: "first", Path: "migrations", Err: os.ErrNotExist}
+}
+
+func (s *migrationsSource) Prev(version uint) (uint, error) {
+	if prev, ok := s.migrations.Prev(version); ok {
+		return prev, nil
+	}
+
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %d", version), Path: "migrations", Err: os.ErrNotExist}
+}
+
+func (s *migrationsSource) Next(version uint) (uint, error) {
+	if next, ok := s.migrations.Next(version); ok {
+		return next, nil
+	}
+
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %d", version), Path: "migrations", Err: os.ErrNotExist}
+}
+
+func (s *migrationsSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	if m, ok := s.migrations.Up(version); ok {
+		return s.render(m)
+	}
+
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read up for version %d", version), Path: "migrations", Err: os.ErrNotExist}
+}
+
+func (s *migrationsSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	if m, ok := s.migrations.Down(version); ok {
+		return s.render(m)
+	}
+
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read down for version %d", version), Path: "migrations", Err: os.ErrNotExist}
+}
+
+func (s *migrationsSource) render(m *source.Migration) (io.ReadCloser, string, error) {
+	body, err := fs.ReadFile(s.fs, m.Raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tmpl, err := template.New(m.Raw).Parse(string(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return nil, "", err
+	}
+
+	return ioutil.NopCloser(&buf), m.Identifier, nil
+}
+
+// setMigrationsTable prefixes the schema version table, sqlite3 driver ignores
+// x-migrations-table when creating the table so the default is changed
+func setMigrationsTable(prefix string) {
+	postgres.DefaultMigrationsTable = prefix + "schema_migrations"
+	sqlite3.DefaultMigrationsTable = prefix + "schema_migrations"
+}
+
+// newMigrate returns migrate instance for the database, SQLite migrations are
+// read from the sqlite3 subdirectory of migrations
+func newMigrate(database DatabaseConfig, migrations fs.FS) (*migrate.Migrate, *migrationsSource, error) {
+	var err error
+	if dialect, _ := databaseDialect(database.Connection); dialect == dialectSqlite {
+		if migrations, err = fs.Sub(migrations, dialectSqlite); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	src, err := newMigrationsSource(migrations, database.TablePrefix)
+	if err != nil {
+		fmt.Println("Migrations do not exist or permission denied")
+		return nil, nil, err
+	}
+
+	setMigrationsTable(database.TablePrefix)
+
+	m, err := migrate.NewWithSourceInstance("fs", src, database.Connection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, src, nil
+}
+
 // Migrate function
-func Migrate(database string, version string, path string) error {
-	m, err := migrate.New("file://"+path, database)
+func Migrate(database DatabaseConfig, version string, migrations fs.FS) error {
+	m, _, err := newMigrate(database, migrations)
 	if err != nil {
-		fmt.Printf("Migrations path %s does not exist or permission denied\n", path)
 		return err
 	}
 
@@ -77,7 +428,7 @@ func Migrate(database string, version string, path string) error {
 		return m.Migrate(uint(ver))
 	}
 
-	fmt.Printf("Migrations not found in path %s\n", path)
+	fmt.Println("Migrations not found")
 
 	return errors.New("migrations not found")
 }
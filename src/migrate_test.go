@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate_createMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mg-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, dialectSqlite), 0755)
+	ioutil.WriteFile(filepath.Join(dir, dialectSqlite, "2000000000_app.up.sql"), nil, 0644)
+
+	created, err := createMigration(dir, "add_column", time.Unix(1000000000, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "2000000001_add_column.up.sql"),
+		filepath.Join(dir, "2000000001_add_column.down.sql"),
+		filepath.Join(dir, dialectSqlite, "2000000001_add_column.up.sql"),
+		filepath.Join(dir, dialectSqlite, "2000000001_add_column.down.sql"),
+	}, created)
+
+	created, err = createMigration(dir, "add_column", time.Unix(3000000000, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "3000000000_add_column.up.sql"), created[0])
+
+	_, err = createMigration(dir, "Add column", time.Now())
+	assert.Error(t, err)
+}
+
+func TestMigrate_pending(t *testing.T) {
+	migrations, err := fs.Sub(assets, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := newMigrationsSource(migrations, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, ok := src.last()
+	assert.True(t, ok)
+
+	all := src.pending(0, true)
+	assert.Equal(t, "1525942800_app.up.sql", all[0])
+	assert.Empty(t, src.pending(last, false))
+	assert.Equal(t, []string{all[len(all)-1]}, src.pending(1792431200, false))
+}
@@ -1,23 +1,104 @@
 package main
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
-
-	"github.com/jinzhu/gorm/dialects/postgres"
 )
 
+// JSON column stored as jsonb in Postgres and as text in SQLite
+type JSON struct {
+	json.RawMessage
+}
+
+// Value returns JSON as bytes, empty value is stored as NULL
+func (j JSON) Value() (driver.Value, error) {
+	if len(j.RawMessage) == 0 {
+		return nil, nil
+	}
+
+	return j.MarshalJSON()
+}
+
+// Scan reads JSON from bytes of Postgres or string of SQLite
+func (j *JSON) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		j.RawMessage = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, j)
+	case string:
+		return json.Unmarshal([]byte(v), j)
+	}
+
+	return fmt.Errorf("failed to unmarshal JSON value: %v", value)
+}
+
 // Connection model
 type Connection struct {
 	ID        int    `gorm:"primary_key"`
 	ClientID  string `gorm:"client_id type:varchar(70);not null;unique" json:"clientId,omitempty"`
-	APIKEY    string `gorm:"api_key type:varchar(100);not null" json:"api_key,omitempty" binding:"required"`
+	APIKEY    string `gorm:"api_key type:text;not null" json:"api_key,omitempty" binding:"required"`
 	APIURL    string `gorm:"api_url type:varchar(255);not null" json:"api_url,omitempty" binding:"required,validatecrmurl"`
 	MGURL     string `gorm:"mg_url type:varchar(255);not null;" json:"mg_url,omitempty"`
-	MGToken   string `gorm:"mg_token type:varchar(100);not null;unique" json:"mg_token,omitempty"`
+	MGToken   string `gorm:"mg_token type:text;not null;unique" json:"mg_token,omitempty"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
-	Active    bool           `json:"active,omitempty"`
-	Commands  postgres.Jsonb `gorm:"commands type:jsonb;" json:"commands,omitempty"`
-	Lang      string         `gorm:"lang type:varchar(2)" json:"lang,omitempty"`
-	Currency  string         `gorm:"currency type:varchar(12)" json:"currency,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Active    bool       `json:"active,omitempty"`
+	Commands  JSON       `gorm:"commands type:jsonb;" json:"commands,omitempty"`
+	Lang      string     `gorm:"lang type:varchar(2)" json:"lang,omitempty"`
+	Currency  string     `gorm:"currency type:varchar(12)" json:"currency,omitempty"`
+
+	ChatRateLimit       int `gorm:"chat_rate_limit type:integer" json:"chat_rate_limit,omitempty"`
+	ConnectionRateLimit int `gorm:"connection_rate_limit type:integer" json:"connection_rate_limit,omitempty"`
+
+	RealtimeStock bool `gorm:"realtime_stock" json:"realtime_stock,omitempty"`
+	Broken        bool `gorm:"broken" json:"broken,omitempty"`
+}
+
+// Instance model
+type Instance struct {
+	ID          string `gorm:"primary_key;type:varchar(64)"`
+	HeartbeatAt time.Time
+}
+
+// ConnectionLease model
+type ConnectionLease struct {
+	ClientID   string `gorm:"primary_key;type:varchar(70)"`
+	InstanceID string `gorm:"type:varchar(64);not null"`
+	ExpiresAt  time.Time
+}
+
+// ProcessedMessage model
+type ProcessedMessage struct {
+	ClientID  string `gorm:"primary_key;type:varchar(70)"`
+	MessageID uint64 `gorm:"primary_key;auto_increment:false"`
+	CreatedAt time.Time
+}
+
+// OutboxMessage model
+type OutboxMessage struct {
+	ID            int       `gorm:"primary_key" json:"id"`
+	ClientID      string    `gorm:"type:varchar(70);not null" json:"clientId"`
+	Payload       JSON      `gorm:"type:jsonb;not null" json:"payload"`
+	Status        string    `gorm:"type:varchar(16);not null" json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `gorm:"type:text" json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	TraceParent   string    `gorm:"type:varchar(55)" json:"traceParent,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// AuditRecord model
+type AuditRecord struct {
+	ID        int       `gorm:"primary_key" json:"id"`
+	ClientID  string    `gorm:"type:varchar(70);not null" json:"clientId"`
+	Action    string    `gorm:"type:varchar(32);not null" json:"action"`
+	Source    string    `gorm:"type:varchar(16);not null" json:"source"`
+	Changes   JSON      `gorm:"type:jsonb;not null" json:"changes"`
+	CreatedAt time.Time `json:"createdAt"`
 }
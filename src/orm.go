@@ -1,20 +1,53 @@
 package main
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mattn/go-sqlite3"
 )
 
+const (
+	dialectPostgres = "postgres"
+	dialectSqlite   = "sqlite3"
+	driverSqliteUTC = "sqlite3_utc"
+)
+
+func init() {
+	sql.Register(driverSqliteUTC, &sqliteUTCDriver{})
+}
+
 // Orm struct
 type Orm struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	prefix string
+}
+
+// databaseDialect returns dialect and data source name of the connection,
+// "sqlite3://path/to/file.db" selects SQLite, other values are Postgres URLs
+func databaseDialect(connection string) (dialect string, source string) {
+	if strings.HasPrefix(connection, dialectSqlite+"://") {
+		return dialectSqlite, strings.TrimPrefix(connection, dialectSqlite+"://")
+	}
+
+	return dialectPostgres, connection
 }
 
 // NewDb init new database connection
 func NewDb(config *BotConfig) *Orm {
-	db, err := gorm.Open("postgres", config.Database.Connection)
+	dialect, source := databaseDialect(config.Database.Connection)
+
+	driverName := dialect
+	if dialect == dialectSqlite {
+		driverName = driverSqliteUTC
+	}
+
+	db, err := gorm.Open(dialect, driverName, source)
 	if err != nil {
 		panic(err)
 	}
@@ -23,15 +56,73 @@ func NewDb(config *BotConfig) *Orm {
 	db.DB().SetMaxOpenConns(config.Database.MaxOpenConnections)
 	db.DB().SetMaxIdleConns(config.Database.MaxIdleConnections)
 
+	// SQLite allows a single writer, concurrent connections fail with "database is locked"
+	if dialect == dialectSqlite {
+		db.DB().SetMaxOpenConns(1)
+	}
+
+	prefix := config.Database.TablePrefix
+	gorm.DefaultTableNameHandler = func(db *gorm.DB, name string) string {
+		return prefix + name
+	}
+
 	db.SingularTable(true)
 	db.LogMode(config.Database.Logging)
 
 	return &Orm{
-		DB: db,
+		DB:     db,
+		prefix: prefix,
 	}
 }
 
+// table returns name of the table with the configured prefix for raw queries
+func (orm *Orm) table(name string) string {
+	return orm.prefix + name
+}
+
+// sqlite reports whether the database is SQLite
+func (orm *Orm) sqlite() bool {
+	return orm.DB.Dialect().GetName() == dialectSqlite
+}
+
 // Close connection
 func (orm *Orm) Close() {
 	orm.DB.Close()
 }
+
+// sqliteUTCDriver opens SQLite connections binding times in UTC. SQLite
+// stores times as text with the offset they were written with, so times
+// in different zones would be compared as strings incorrectly.
+type sqliteUTCDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteUTCDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteUTCConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteUTCConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// CheckNamedValue converts times to UTC, other values are left to the
+// default converter
+func (c *sqliteUTCConn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case time.Time:
+		nv.Value = v.UTC()
+		return nil
+	case *time.Time:
+		if v != nil {
+			nv.Value = v.UTC()
+			return nil
+		}
+	}
+
+	return driver.ErrSkip
+}
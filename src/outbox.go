@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusDead    = "dead"
+)
+
+var outbox *Outbox
+
+// Outbox stores replies in the database and delivers them to MG, retrying
+// server and network errors with exponential backoff. Messages rejected by MG
+// or exceeding the attempts limit stay in the table as dead letters.
+type Outbox struct {
+	connections   ConnectionRepository
+	wake          chan struct{}
+	batchSize     int
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+// NewOutbox returns outbox configured by c
+func NewOutbox(c OutboxConfig, connections ConnectionRepository) *Outbox {
+	o := &Outbox{
+		connections:   connections,
+		wake:          make(chan struct{}, 1),
+		batchSize:     c.BatchSize,
+		maxAttempts:   c.MaxAttempts,
+		retryDelay:    time.Duration(c.RetryDelay) * time.Second,
+		maxRetryDelay: time.Duration(c.MaxRetryDelay) * time.Second,
+	}
+
+	if o.batchSize <= 0 {
+		o.batchSize = 100
+	}
+	if o.maxAttempts <= 0 {
+		o.maxAttempts = 10
+	}
+	if o.retryDelay <= 0 {
+		o.retryDelay = 5 * time.Second
+	}
+	if o.maxRetryDelay < o.retryDelay {
+		o.maxRetryDelay = o.retryDelay
+	}
+
+	return o
+}
+
+// enqueue stores the message with the trace context of ctx, so sending
+// continues the trace of the event it replies to
+func (o *Outbox) enqueue(ctx context.Context, clientID string, msg v1.MessageSendRequest) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	m := &OutboxMessage{
+		ClientID:      clientID,
+		Status:        OutboxStatusPending,
+		NextAttemptAt: time.Now(),
+		TraceParent:   traceParent(ctx),
+	}
+	m.Payload.RawMessage = payload
+
+	if err := m.createOutboxMessage(); err != nil {
+		return err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (o *Outbox) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		o.deliver()
+
+		select {
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) deliver() {
+	for {
+		now := time.Now()
+		messages, err := claimOutboxMessages(o.batchSize, now, now.Add(time.Minute))
+		if err != nil {
+			logger.Errorf("outbox: claim messages: %v", err)
+			return
+		}
+
+		for _, m := range messages {
+			o.send(m)
+		}
+
+		if len(messages) < o.batchSize {
+			return
+		}
+	}
+}
+
+func (o *Outbox) send(m *OutboxMessage) {
+	var (
+		msg    v1.MessageSendRequest
+		status int
+	)
+
+	err := json.Unmarshal(m.Payload.RawMessage, &msg)
+	permanent := err != nil
+
+	conn := o.connections.Get(m.ClientID)
+	if err == nil && conn.ID == 0 {
+		err = errors.New("connection not found")
+		permanent = true
+	}
+
+	if err == nil {
+		mgClient := v1.New(conn.MGURL, conn.MGToken)
+		mgClient.Debug = config.Debug
+		_, span := tracer.Start(traceContext(m.TraceParent), "mg.message_send", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("client_id", m.ClientID),
+				attribute.Int("outbox.attempt", m.Attempts+1),
+			),
+		)
+		start := time.Now()
+		_, status, err = mgClient.MessageSend(msg)
+		observeDuration(mgRequestDuration, "message_send", start, err)
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		endSpan(span, err)
+		class := errorClass(newMGError(status, err))
+		permanent = err != nil && class != ErrorClassTransient && class != ErrorClassRateLimited
+	}
+
+	if err == nil {
+		if err := m.deleteOutboxMessage(); err != nil {
+			logger.Errorf("outbox: delete message %d: %v", m.ID, err)
+		}
+		return
+	}
+
+	m.Attempts++
+	m.LastError = err.Error()
+
+	if permanent || m.Attempts >= o.maxAttempts {
+		m.Status = OutboxStatusDead
+		messageSendFailuresTotal.WithLabelValues("dead").Inc()
+		withFields(logger, LogFields{"client_id": m.ClientID}).Warningf("outbox: message %d is dead, status: %d, err: %v", m.ID, status, err)
+	} else {
+		m.NextAttemptAt = time.Now().Add(o.backoff(m.Attempts))
+		messageSendFailuresTotal.WithLabelValues("retry").Inc()
+	}
+
+	if err := m.saveOutboxMessage(); err != nil {
+		logger.Errorf("outbox: save message %d: %v", m.ID, err)
+	}
+}
+
+// traceParent returns the W3C traceparent header of the span in ctx
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	return carrier.Get("traceparent")
+}
+
+// traceContext returns context carrying the remote span of traceparent
+func traceContext(traceparent string) context.Context {
+	return propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceparent})
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.retryDelay
+	for i := 1; i < attempts && delay < o.maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > o.maxRetryDelay {
+		delay = o.maxRetryDelay
+	}
+
+	return delay
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendOutboxMessage(t *testing.T, status int, body string) *OutboxMessage {
+	defer gock.Off()
+
+	gock.New("https://test.retailcrm.pro").
+		Post("/api/bot/v1/messages").
+		Reply(status).
+		BodyString(body)
+
+	repo := NewGormConnectionRepository(orm)
+	orm.DB.Unscoped().Delete(Connection{}, "client_id = ?", clientID)
+	defer orm.DB.Unscoped().Delete(Connection{}, "client_id = ?", clientID)
+
+	err := repo.Create(&Connection{
+		ClientID: clientID,
+		APIKEY:   "ii32if32iuf23iufn2uifnr23inf",
+		APIURL:   crmUrl,
+		MGURL:    "https://test.retailcrm.pro",
+		MGToken:  "988730985u23r390rf8j3984jf32904fj",
+		Active:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := NewOutbox(OutboxConfig{MaxAttempts: 3}, repo)
+	err = o.enqueue(context.Background(), clientID, v1.MessageSendRequest{
+		Type:    v1.MsgTypeText,
+		Scope:   v1.MessageScopePrivate,
+		ChatID:  1,
+		Content: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := claimOutboxMessages(o.batchSize, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("expected one claimed message, got %d", len(messages))
+	}
+
+	o.send(messages[0])
+
+	var m OutboxMessage
+	orm.DB.First(&m, messages[0].ID)
+
+	return &m
+}
+
+func TestOutbox_delivered(t *testing.T) {
+	requireDB(t)
+
+	defer orm.DB.Delete(OutboxMessage{}, "client_id = ?", clientID)
+
+	m := sendOutboxMessage(t, 200, `{"message_id": 1, "time": "2018-01-01T00:00:00+03:00"}`)
+
+	assert.Equal(t, 0, m.ID, "delivered message must be removed")
+}
+
+func TestOutbox_retry(t *testing.T) {
+	requireDB(t)
+
+	defer orm.DB.Delete(OutboxMessage{}, "client_id = ?", clientID)
+
+	m := sendOutboxMessage(t, 503, `{}`)
+
+	assert.Equal(t, OutboxStatusPending, m.Status)
+	assert.Equal(t, 1, m.Attempts)
+	assert.True(t, m.NextAttemptAt.After(time.Now()), "retry must be postponed")
+}
+
+func TestOutbox_retryRateLimited(t *testing.T) {
+	requireDB(t)
+
+	defer orm.DB.Delete(OutboxMessage{}, "client_id = ?", clientID)
+
+	m := sendOutboxMessage(t, 429, `{"errors": ["too many requests"]}`)
+
+	assert.Equal(t, OutboxStatusPending, m.Status)
+	assert.Equal(t, 1, m.Attempts)
+}
+
+func TestOutbox_dead(t *testing.T) {
+	requireDB(t)
+
+	defer orm.DB.Delete(OutboxMessage{}, "client_id = ?", clientID)
+
+	m := sendOutboxMessage(t, 400, `{"errors": ["chat not found"]}`)
+
+	assert.Equal(t, OutboxStatusDead, m.Status)
+	assert.Equal(t, "chat not found", m.LastError)
+	assert.Len(t, getDeadOutboxMessages(clientID, 10), 1)
+}
+
+func TestOutbox_traceParent(t *testing.T) {
+	defer useSqlite(t)()
+	defer gock.Off()
+	exporter := recordSpans()
+
+	gock.New("https://test.retailcrm.pro").
+		Post("/api/bot/v1/messages").
+		Reply(200).
+		BodyString(`{"message_id": 1, "time": "2018-01-01T00:00:00+03:00"}`)
+
+	repo := NewMemoryConnectionRepository()
+	err := repo.Create(&Connection{
+		ClientID: clientID,
+		MGURL:    "https://test.retailcrm.pro",
+		MGToken:  "988730985u23r390rf8j3984jf32904fj",
+		Active:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := NewOutbox(OutboxConfig{}, repo)
+	ctx, span := tracer.Start(context.Background(), "ws.event")
+	err = o.enqueue(ctx, clientID, v1.MessageSendRequest{
+		Type:    v1.MsgTypeText,
+		Scope:   v1.MessageScopePrivate,
+		ChatID:  1,
+		Content: "test",
+	})
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := claimOutboxMessages(o.batchSize, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+
+	o.send(messages[0])
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "mg.message_send", spans[1].Name)
+		assert.Equal(t, span.SpanContext().TraceID(), spans[1].SpanContext.TraceID())
+		assert.Equal(t, span.SpanContext().SpanID(), spans[1].Parent.SpanID())
+	}
+	assert.False(t, gock.IsPending())
+}
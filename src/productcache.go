@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v5 "github.com/retailcrm/api-client-go/v5"
+)
+
+var products *ProductCache
+
+// ProductCache keeps results of product searches in a bounded LRU. Found
+// products are kept for ttl while their quantity and price go stale after the
+// shorter stockTTL and have to be requested again by product ids.
+type ProductCache struct {
+	mutex    sync.Mutex
+	size     int
+	ttl      time.Duration
+	stockTTL time.Duration
+	items    *list.List
+	index    map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type productEntry struct {
+	key          string
+	products     []v5.Product
+	expires      time.Time
+	stockExpires time.Time
+}
+
+// ProductCacheStats struct
+type ProductCacheStats struct {
+	Size   int    `json:"size"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// NewProductCache returns cache configured by c, zero size or ttl disables caching
+// and stock ttl not set or exceeding ttl falls back to ttl
+func NewProductCache(c CacheConfig) *ProductCache {
+	ttl := time.Duration(c.ProductTTL) * time.Second
+	stockTTL := time.Duration(c.StockTTL) * time.Second
+	if stockTTL <= 0 || stockTTL > ttl {
+		stockTTL = ttl
+	}
+
+	return &ProductCache{
+		size:     c.ProductSize,
+		ttl:      ttl,
+		stockTTL: stockTTL,
+		items:    list.New(),
+		index:    map[string]*list.Element{},
+	}
+}
+
+func (c *ProductCache) enabled() bool {
+	return c != nil && c.size > 0 && c.ttl > 0
+}
+
+func productCacheKey(clientID, query string) string {
+	return fmt.Sprintf("%s:%s", clientID, strings.ToLower(strings.Join(strings.Fields(query), " ")))
+}
+
+// get returns the cached search, the second result reports that quantity and
+// price of the found products have expired and must be refreshed
+func (c *ProductCache) get(clientID, query string) ([]v5.Product, bool, bool) {
+	key := productCacheKey(clientID, query)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.index[key]; ok {
+		entry := el.Value.(*productEntry)
+		now := time.Now()
+		if now.Before(entry.expires) {
+			c.items.MoveToFront(el)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.products, len(entry.products) > 0 && !now.Before(entry.stockExpires), true
+		}
+
+		c.items.Remove(el)
+		delete(c.index, key)
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+
+	return nil, false, false
+}
+
+func (c *ProductCache) put(clientID, query string, products []v5.Product) {
+	key := productCacheKey(clientID, query)
+	now := time.Now()
+	entry := &productEntry{
+		key:          key,
+		products:     products,
+		expires:      now.Add(c.ttl),
+		stockExpires: now.Add(c.stockTTL),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.index[key]; ok {
+		el.Value = entry
+		c.items.MoveToFront(el)
+		return
+	}
+
+	c.index[key] = c.items.PushFront(entry)
+	if c.items.Len() > c.size {
+		el := c.items.Back()
+		c.items.Remove(el)
+		delete(c.index, el.Value.(*productEntry).key)
+	}
+}
+
+// refresh replaces the products of the cached search with their fresh copies
+// keeping the search expiry, products missing from fresh are dropped
+func (c *ProductCache) refresh(clientID, query string, fresh []v5.Product) []v5.Product {
+	byID := make(map[int]v5.Product, len(fresh))
+	for _, p := range fresh {
+		byID[p.ID] = p
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.index[productCacheKey(clientID, query)]
+	if !ok {
+		return fresh
+	}
+
+	entry := el.Value.(*productEntry)
+	refreshed := make([]v5.Product, 0, len(entry.products))
+	for _, p := range entry.products {
+		if f, ok := byID[p.ID]; ok {
+			refreshed = append(refreshed, f)
+		}
+	}
+
+	el.Value = &productEntry{
+		key:          entry.key,
+		products:     refreshed,
+		expires:      entry.expires,
+		stockExpires: time.Now().Add(c.stockTTL),
+	}
+
+	return refreshed
+}
+
+// invalidate drops the cached searches of the connection
+func (c *ProductCache) invalidate(clientID string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, el := range c.index {
+		if strings.HasPrefix(key, clientID+":") {
+			c.items.Remove(el)
+			delete(c.index, key)
+		}
+	}
+}
+
+func (c *ProductCache) stats() ProductCacheStats {
+	if c == nil {
+		return ProductCacheStats{}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return ProductCacheStats{
+		Size:   c.items.Len(),
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
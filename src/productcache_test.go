@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v5 "github.com/retailcrm/api-client-go/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProductCache(t *testing.T) {
+	c := NewProductCache(CacheConfig{ProductSize: 2, ProductTTL: 60})
+	list := []v5.Product{{ID: 1}}
+
+	_, _, ok := c.get(clientID, "T-shirt")
+	assert.False(t, ok)
+
+	c.put(clientID, "T-shirt", list)
+	res, stale, ok := c.get(clientID, "  t-shirt ")
+	assert.True(t, ok, "normalized query must hit the cache")
+	assert.False(t, stale)
+	assert.Equal(t, list, res)
+
+	_, _, ok = c.get("other", "T-shirt")
+	assert.False(t, ok, "searches of other connections must not be shared")
+
+	c.put(clientID, "shoes", list)
+	c.put(clientID, "hat", list)
+	_, _, ok = c.get(clientID, "T-shirt")
+	assert.False(t, ok, "least recently used search must be evicted")
+
+	c.invalidate(clientID)
+	assert.Equal(t, ProductCacheStats{Size: 0, Hits: 1, Misses: 3}, c.stats())
+}
+
+func TestProductCache_stock(t *testing.T) {
+	c := NewProductCache(CacheConfig{ProductSize: 2, ProductTTL: 60, StockTTL: 5})
+	c.put(clientID, "T-shirt", []v5.Product{{ID: 1, Quantity: 10}, {ID: 2, Quantity: 5}})
+
+	el := c.index[productCacheKey(clientID, "T-shirt")]
+	el.Value.(*productEntry).stockExpires = time.Now().Add(-time.Second)
+
+	res, stale, ok := c.get(clientID, "T-shirt")
+	assert.True(t, ok, "search must be cached until product ttl")
+	assert.True(t, stale, "quantity and price must expire after stock ttl")
+	assert.Len(t, res, 2)
+
+	res = c.refresh(clientID, "T-shirt", []v5.Product{{ID: 2, Quantity: 3}, {ID: 1, Quantity: 0}})
+	assert.Equal(t, []v5.Product{{ID: 1, Quantity: 0}, {ID: 2, Quantity: 3}}, res, "search order must be kept")
+
+	res, stale, ok = c.get(clientID, "T-shirt")
+	assert.True(t, ok)
+	assert.False(t, stale)
+	assert.Equal(t, []v5.Product{{ID: 1, Quantity: 0}, {ID: 2, Quantity: 3}}, res)
+
+	res = c.refresh(clientID, "T-shirt", []v5.Product{{ID: 2, Quantity: 3}})
+	assert.Equal(t, []v5.Product{{ID: 2, Quantity: 3}}, res, "products missing in the CRM must be dropped")
+
+	assert.Equal(t, 60*time.Second, NewProductCache(CacheConfig{ProductTTL: 60, StockTTL: 120}).stockTTL)
+	assert.Equal(t, 60*time.Second, NewProductCache(CacheConfig{ProductTTL: 60}).stockTTL)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitWindow   = time.Minute
+	rateLimitMaxChats = 1000
+)
+
+// tokenBucket refills rate tokens per minute up to capacity
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64
+	updated  time.Time
+	notified time.Time
+}
+
+func newTokenBucket(rate, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 || burst > rate {
+		burst = rate
+	}
+
+	return &tokenBucket{
+		tokens:   float64(burst),
+		capacity: float64(burst),
+		rate:     float64(rate) / rateLimitWindow.Seconds(),
+		updated:  now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updated).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.updated = now
+}
+
+// RateLimiter limits commands of a connection and of each of its chats.
+// Zero rate disables the corresponding limit.
+type RateLimiter struct {
+	mutex          sync.Mutex
+	chatRate       int
+	chatBurst      int
+	connection     *tokenBucket
+	connectionRate int
+	chats          map[uint64]*tokenBucket
+}
+
+// NewRateLimiter returns limiter with global limits from c overridden by
+// the limits of the connection.
+func NewRateLimiter(c RateLimitConfig, conn *Connection) *RateLimiter {
+	l := &RateLimiter{
+		chatRate:       c.Chat,
+		chatBurst:      c.ChatBurst,
+		connectionRate: c.Connection,
+		chats:          map[uint64]*tokenBucket{},
+	}
+
+	if conn.ChatRateLimit > 0 {
+		l.chatRate = conn.ChatRateLimit
+	}
+
+	if conn.ConnectionRateLimit > 0 {
+		l.connectionRate = conn.ConnectionRateLimit
+	}
+
+	if l.connectionRate > 0 {
+		l.connection = newTokenBucket(l.connectionRate, c.ConnectionBurst, time.Now())
+	}
+
+	return l
+}
+
+// allow takes a token for the command from the chat and reports whether it
+// may be executed and, if not, whether the chat should be notified about it.
+func (l *RateLimiter) allow(chatID uint64, now time.Time) (ok bool, notify bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var chat *tokenBucket
+	if l.chatRate > 0 {
+		chat = l.chats[chatID]
+		if chat == nil {
+			l.sweep(now)
+			chat = newTokenBucket(l.chatRate, l.chatBurst, now)
+			l.chats[chatID] = chat
+		}
+		chat.refill(now)
+	}
+
+	if l.connection != nil {
+		l.connection.refill(now)
+	}
+
+	if (chat == nil || chat.tokens >= 1) && (l.connection == nil || l.connection.tokens >= 1) {
+		if chat != nil {
+			chat.tokens--
+		}
+		if l.connection != nil {
+			l.connection.tokens--
+		}
+		return true, false
+	}
+
+	notified := l.connection
+	if chat != nil {
+		notified = chat
+	}
+
+	if now.Sub(notified.notified) < rateLimitWindow {
+		return false, false
+	}
+	notified.notified = now
+
+	return false, true
+}
+
+// sweep forgets the chats with full buckets when there are too many of them
+func (l *RateLimiter) sweep(now time.Time) {
+	if len(l.chats) < rateLimitMaxChats {
+		return
+	}
+
+	for id, b := range l.chats {
+		b.refill(now)
+		if b.tokens >= b.capacity && now.Sub(b.notified) >= rateLimitWindow {
+			delete(l.chats, id)
+		}
+	}
+}
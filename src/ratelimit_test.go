@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_chat(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Chat: 60, ChatBurst: 2}, &Connection{})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.allow(1, now)
+		assert.True(t, ok)
+	}
+
+	ok, notify := l.allow(1, now)
+	assert.False(t, ok, "burst must be exhausted")
+	assert.True(t, notify, "chat must be notified once")
+
+	ok, notify = l.allow(1, now.Add(100*time.Millisecond))
+	assert.False(t, ok)
+	assert.False(t, notify, "chat must not be notified twice per window")
+
+	ok, _ = l.allow(2, now)
+	assert.True(t, ok, "other chats must not be limited")
+
+	ok, _ = l.allow(1, now.Add(time.Second))
+	assert.True(t, ok, "bucket must be refilled")
+}
+
+func TestRateLimiter_connectionOverride(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Connection: 100}, &Connection{ConnectionRateLimit: 1})
+	now := time.Now()
+
+	ok, _ := l.allow(1, now)
+	assert.True(t, ok)
+
+	ok, _ = l.allow(2, now)
+	assert.False(t, ok, "connection override must be applied")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var references *ReferenceCache
+
+// ReferenceCache keeps CRM reference data of connections for ttl. Concurrent
+// misses of the same reference are coalesced into a single CRM request.
+type ReferenceCache struct {
+	mutex       sync.RWMutex
+	ttl         time.Duration
+	entries     map[string]referenceEntry
+	generations map[string]int
+	group       singleflight.Group
+}
+
+type referenceEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// NewReferenceCache returns cache configured by c, zero ttl disables caching
+func NewReferenceCache(c CacheConfig) *ReferenceCache {
+	return &ReferenceCache{
+		ttl:         time.Duration(c.ReferenceTTL) * time.Second,
+		entries:     map[string]referenceEntry{},
+		generations: map[string]int{},
+	}
+}
+
+// get returns the cached reference of the connection or loads it
+func (c *ReferenceCache) get(clientID, name string, load func() (interface{}, error)) (interface{}, error) {
+	if c == nil || c.ttl <= 0 {
+		return load()
+	}
+
+	c.mutex.RLock()
+	key := fmt.Sprintf("%s:%s", clientID, name)
+	entry, ok := c.entries[key]
+	generation := c.generations[clientID]
+	c.mutex.RUnlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err, _ := c.group.Do(fmt.Sprintf("%s:%d", key, generation), func() (interface{}, error) {
+		value, err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		c.mutex.Lock()
+		if c.generations[clientID] == generation {
+			c.entries[key] = referenceEntry{value: value, expires: time.Now().Add(c.ttl)}
+		}
+		c.mutex.Unlock()
+
+		return value, nil
+	})
+
+	return value, err
+}
+
+// invalidate drops the references of the connection, loads in flight are not cached
+func (c *ReferenceCache) invalidate(clientID string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generations[clientID]++
+	for key := range c.entries {
+		if strings.HasPrefix(key, clientID+":") {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferenceCache(t *testing.T) {
+	c := NewReferenceCache(CacheConfig{ReferenceTTL: 60})
+
+	var loads int32
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.get(clientID, "payment-types", load)
+			assert.NoError(t, err)
+			assert.Equal(t, "value", v)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads), "concurrent misses must be coalesced")
+
+	c.get(clientID, "payment-types", load)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads), "cached value must be returned")
+
+	c.invalidate(clientID)
+	c.get(clientID, "payment-types", load)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loads), "invalidated value must be loaded again")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/retailcrm/api-client-go/v5"
+)
+
+func init() {
+	parser.AddCommand("relink",
+		"Refresh settings links of connections in the CRM",
+		"Register the integration module of every active connection with a freshly signed settings link. "+
+			"Running workers refresh their links on start, run it after changing session.secret to refresh all of them at once.",
+		&RelinkCommand{},
+	)
+}
+
+// RelinkCommand struct
+type RelinkCommand struct{}
+
+// Execute method
+func (x *RelinkCommand) Execute(args []string) error {
+	config = LoadConfig(options.Config)
+	orm = NewDb(config)
+	logger = newLogger()
+	defer orm.DB.Close()
+
+	var err error
+	if keyRing, err = NewKeyRing(config.Encryption); err != nil {
+		return err
+	}
+
+	if sessionSecret, err = newSessionSecret(config.Session); err != nil {
+		return err
+	}
+
+	repo := NewGormConnectionRepository(orm)
+	count, failed := 0, 0
+	for _, conn := range repo.Active() {
+		if err := refreshSettingsLink(repo, v5.New(conn.APIURL, conn.APIKEY), conn); err != nil {
+			withFields(logger, LogFields{"client_id": conn.ClientID, "crm_url": conn.APIURL}).
+				Errorf("relink: %v", err)
+			failed++
+			continue
+		}
+		count++
+	}
+
+	fmt.Printf("Refreshed %d settings links, %d failed\n", count, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d settings links are not refreshed", failed)
+	}
+
+	return nil
+}
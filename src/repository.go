@@ -1,44 +1,405 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 var rx = regexp.MustCompile(`/+$`)
 
-func getConnection(uid string) *Connection {
-	var connection Connection
-	orm.DB.First(&connection, "client_id = ?", uid)
+// ConnectionRepository stores connections and the audit log of their changes.
+// Getters return connection with zero ID when it is not found.
+type ConnectionRepository interface {
+	Get(clientID string) *Connection
+	GetByURL(apiURL string) *Connection
+	// GetDeleted returns uninstalled connection kept for the retention period
+	GetDeleted(clientID string) *Connection
+	GetDeletedByURL(apiURL string) *Connection
+	Active() []*Connection
 
-	return &connection
+	Create(c *Connection) error
+	Save(c *Connection) error
+	SetActivity(c *Connection) error
+	SetBotSettings(c *Connection) error
+	SetRateLimit(c *Connection) error
+	SetBroken(c *Connection) error
+
+	// Delete soft deletes the connection, it is purged by PurgeDeleted
+	Delete(c *Connection) error
+	Restore(c *Connection) error
+	// Purge hard deletes uninstalled connection with its messages and lease
+	Purge(clientID string) error
+	// PurgeDeleted hard deletes connections uninstalled before the time
+	PurgeDeleted(before time.Time) (int, error)
+
+	AddAudit(r *AuditRecord) error
+	Audit(clientID string, limit int) []*AuditRecord
+}
+
+// GormConnectionRepository stores connections in the database, secrets are
+// encrypted with keyRing
+type GormConnectionRepository struct {
+	orm *Orm
 }
 
-func getConnectionByURL(urlCrm string) *Connection {
+// NewGormConnectionRepository returns repository using o
+func NewGormConnectionRepository(o *Orm) *GormConnectionRepository {
+	return &GormConnectionRepository{orm: o}
+}
+
+func (r *GormConnectionRepository) first(db *gorm.DB, where string, value string) *Connection {
 	var connection Connection
-	orm.DB.First(&connection, "api_url = ?", urlCrm)
+	db.First(&connection, where, value)
+	if err := connection.openSecrets(); err != nil {
+		logger.Errorf("connection %s: %v", connection.ClientID, err)
+	}
 
 	return &connection
 }
 
-func getActiveConnection() []*Connection {
+func (r *GormConnectionRepository) Get(clientID string) *Connection {
+	return r.first(r.orm.DB, "client_id = ?", clientID)
+}
+
+func (r *GormConnectionRepository) GetByURL(apiURL string) *Connection {
+	return r.first(r.orm.DB, "api_url = ?", apiURL)
+}
+
+func (r *GormConnectionRepository) GetDeleted(clientID string) *Connection {
+	return r.first(r.orm.DB.Unscoped().Where("deleted_at is not null"), "client_id = ?", clientID)
+}
+
+func (r *GormConnectionRepository) GetDeletedByURL(apiURL string) *Connection {
+	return r.first(r.orm.DB.Unscoped().Where("deleted_at is not null"), "api_url = ?", apiURL)
+}
+
+func (r *GormConnectionRepository) Active() []*Connection {
 	var connection []*Connection
-	orm.DB.Find(&connection, "active = ?", true)
+	r.orm.DB.Find(&connection, "active = ?", true)
+
+	active := connection[:0]
+	for _, c := range connection {
+		if err := c.openSecrets(); err != nil {
+			logger.Errorf("connection %s: %v, worker is not started", c.ClientID, err)
+			continue
+		}
+		active = append(active, c)
+	}
+
+	return active
+}
+
+func (r *GormConnectionRepository) Create(c *Connection) error {
+	return c.sealSecrets(func() error {
+		return r.orm.DB.Create(c).Error
+	})
+}
+
+func (r *GormConnectionRepository) Save(c *Connection) error {
+	return c.sealSecrets(func() error {
+		return r.orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update(c).Error
+	})
+}
+
+func (r *GormConnectionRepository) update(c *Connection, fields map[string]interface{}) error {
+	return r.orm.DB.Model(c).Where("client_id = ?", c.ClientID).Updates(fields).Error
+}
 
-	return connection
+func (r *GormConnectionRepository) SetActivity(c *Connection) error {
+	return r.update(c, map[string]interface{}{"active": c.Active, "api_url": c.APIURL})
 }
 
-func (c *Connection) setConnectionActivity() error {
-	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Updates(map[string]interface{}{"active": c.Active, "api_url": c.APIURL}).Error
+func (r *GormConnectionRepository) SetBotSettings(c *Connection) error {
+	return r.update(c, map[string]interface{}{
+		"lang":           c.Lang,
+		"currency":       c.Currency,
+		"realtime_stock": c.RealtimeStock,
+	})
+}
+
+func (r *GormConnectionRepository) SetRateLimit(c *Connection) error {
+	return r.update(c, map[string]interface{}{
+		"chat_rate_limit":       c.ChatRateLimit,
+		"connection_rate_limit": c.ConnectionRateLimit,
+	})
+}
+
+func (r *GormConnectionRepository) SetBroken(c *Connection) error {
+	return r.update(c, map[string]interface{}{"broken": c.Broken})
+}
+
+func (r *GormConnectionRepository) Delete(c *Connection) error {
+	return r.orm.DB.Where("client_id = ?", c.ClientID).Delete(&Connection{}).Error
+}
+
+func (r *GormConnectionRepository) Restore(c *Connection) error {
+	return r.orm.DB.Unscoped().Model(&Connection{}).Where("client_id = ?", c.ClientID).Updates(map[string]interface{}{
+		"deleted_at": nil,
+	}).Error
+}
+
+func (r *GormConnectionRepository) PurgeDeleted(before time.Time) (count int, err error) {
+	var ids []string
+	err = r.orm.DB.Unscoped().Model(&Connection{}).Where("deleted_at < ?", before).Pluck("client_id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := r.Purge(id); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (r *GormConnectionRepository) Purge(clientID string) error {
+	tx := r.orm.DB.Begin()
+
+	for _, model := range []interface{}{&OutboxMessage{}, &ProcessedMessage{}, &ConnectionLease{}} {
+		if err := tx.Where("client_id = ?", clientID).Delete(model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err := tx.Unscoped().Where("client_id = ? and deleted_at is not null", clientID).Delete(&Connection{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (r *GormConnectionRepository) AddAudit(record *AuditRecord) error {
+	return r.orm.DB.Create(record).Error
+}
+
+func (r *GormConnectionRepository) Audit(clientID string, limit int) []*AuditRecord {
+	var records []*AuditRecord
+	r.orm.DB.Where("client_id = ?", clientID).Order("id desc").Limit(limit).Find(&records)
+
+	return records
+}
+
+// Encrypt seals secrets of all connections with the current key, plain
+// values are encrypted and values sealed with older keys are rewrapped.
+func (r *GormConnectionRepository) Encrypt() (count int, err error) {
+	var connections []*Connection
+	if err := r.orm.DB.Find(&connections).Error; err != nil {
+		return 0, err
+	}
+
+	for _, c := range connections {
+		apiKey, apiKeyChanged, err := keyRing.rewrap(c.APIKEY)
+		if err != nil {
+			return count, fmt.Errorf("connection %s: api key: %v", c.ClientID, err)
+		}
+
+		mgToken, mgTokenChanged, err := keyRing.rewrap(c.MGToken)
+		if err != nil {
+			return count, fmt.Errorf("connection %s: mg token: %v", c.ClientID, err)
+		}
+
+		if !apiKeyChanged && !mgTokenChanged {
+			continue
+		}
+
+		err = r.orm.DB.Model(c).Where("client_id = ?", c.ClientID).UpdateColumns(map[string]interface{}{
+			"api_key":  apiKey,
+			"mg_token": mgToken,
+		}).Error
+		if err != nil {
+			return count, err
+		}
+		count++
+
+		auditChanges(r, AuditSourceCLI, "encrypt", c.ClientID, map[string]AuditChange{
+			"encryption_key": {Old: keyID(c.APIKEY), New: keyRing.current},
+		})
+	}
+
+	return count, nil
 }
 
-func (c *Connection) createConnection() error {
-	return orm.DB.Create(c).Error
+// sealSecrets replaces API key and token of the connection by their
+// encrypted values for the duration of fn
+func (c *Connection) sealSecrets(fn func() error) (err error) {
+	apiKey, mgToken := c.APIKEY, c.MGToken
+	defer func() {
+		c.APIKEY, c.MGToken = apiKey, mgToken
+	}()
+
+	if c.APIKEY, err = keyRing.encrypt(apiKey); err != nil {
+		return err
+	}
+
+	if c.MGToken, err = keyRing.encrypt(mgToken); err != nil {
+		return err
+	}
+
+	return fn()
 }
 
-func (c *Connection) saveConnection() error {
-	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update(c).Error
+// openSecrets decrypts API key and token of the loaded connection. Secrets
+// that can not be decrypted are cleared, so the ciphertext is never sent
+// as a credential.
+func (c *Connection) openSecrets() error {
+	apiKey, err := keyRing.decrypt(c.APIKEY)
+	if err != nil {
+		c.APIKEY, c.MGToken = "", ""
+		return fmt.Errorf("decrypt api key: %v", err)
+	}
+
+	mgToken, err := keyRing.decrypt(c.MGToken)
+	if err != nil {
+		c.APIKEY, c.MGToken = "", ""
+		return fmt.Errorf("decrypt mg token: %v", err)
+	}
+
+	c.APIKEY, c.MGToken = apiKey, mgToken
+
+	return nil
 }
 
 func (c *Connection) NormalizeApiUrl() {
 	c.APIURL = rx.ReplaceAllString(c.APIURL, ``)
 }
+
+func heartbeatInstance(id string, now time.Time) error {
+	return orm.DB.Exec(fmt.Sprintf(
+		`INSERT INTO %s (id, heartbeat_at) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET heartbeat_at = EXCLUDED.heartbeat_at`,
+		orm.table("instance"),
+	), id, now,
+	).Error
+}
+
+func countLiveInstances(since time.Time) (count int, err error) {
+	err = orm.DB.Model(&Instance{}).Where("heartbeat_at >= ?", since).Count(&count).Error
+
+	return
+}
+
+func deleteInstance(id string) error {
+	return orm.DB.Delete(Instance{}, "id = ?", id).Error
+}
+
+func deleteStaleInstances(before time.Time) error {
+	return orm.DB.Delete(Instance{}, "heartbeat_at < ?", before).Error
+}
+
+// acquireLease takes or renews the lease; it succeeds when the lease is free,
+// expired or already held by the instance.
+func acquireLease(clientID, instanceID string, now, expiresAt time.Time) (bool, error) {
+	res := orm.DB.Exec(fmt.Sprintf(
+		`INSERT INTO %[1]s (client_id, instance_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (client_id) DO UPDATE SET instance_id = EXCLUDED.instance_id, expires_at = EXCLUDED.expires_at
+		WHERE %[1]s.instance_id = EXCLUDED.instance_id OR %[1]s.expires_at < ?`,
+		orm.table("connection_lease"),
+	), clientID, instanceID, expiresAt, now,
+	)
+
+	return res.RowsAffected == 1, res.Error
+}
+
+func releaseLease(clientID, instanceID string) error {
+	return orm.DB.Delete(ConnectionLease{}, "client_id = ? AND instance_id = ?", clientID, instanceID).Error
+}
+
+func releaseInstanceLeases(instanceID string) error {
+	return orm.DB.Delete(ConnectionLease{}, "instance_id = ?", instanceID).Error
+}
+
+// markMessageProcessed records the message and reports whether it was not recorded before
+func markMessageProcessed(clientID string, messageID uint64, now time.Time) (bool, error) {
+	res := orm.DB.Exec(fmt.Sprintf(
+		`INSERT INTO %s (client_id, message_id, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (client_id, message_id) DO NOTHING`,
+		orm.table("processed_message"),
+	), clientID, messageID, now,
+	)
+
+	return res.RowsAffected == 1, res.Error
+}
+
+func deleteProcessedMessages(before time.Time) error {
+	return orm.DB.Delete(ProcessedMessage{}, "created_at < ?", before).Error
+}
+
+func (m *OutboxMessage) createOutboxMessage() error {
+	return orm.DB.Create(m).Error
+}
+
+func (m *OutboxMessage) saveOutboxMessage() error {
+	return orm.DB.Save(m).Error
+}
+
+func (m *OutboxMessage) deleteOutboxMessage() error {
+	return orm.DB.Delete(m).Error
+}
+
+// claimOutboxMessages hides due pending messages from other senders until
+// lockUntil and returns them.
+func claimOutboxMessages(limit int, now, lockUntil time.Time) ([]*OutboxMessage, error) {
+	if orm.sqlite() {
+		return claimOutboxMessagesSqlite(limit, now, lockUntil)
+	}
+
+	var messages []*OutboxMessage
+	err := orm.DB.Raw(fmt.Sprintf(
+		`UPDATE %[1]s SET next_attempt_at = ? WHERE id IN (
+			SELECT id FROM %[1]s WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED
+		) RETURNING *`,
+		orm.table("outbox_message"),
+	), lockUntil, OutboxStatusPending, now, limit,
+	).Scan(&messages).Error
+
+	return messages, err
+}
+
+// claimOutboxMessagesSqlite claims messages without RETURNING and row locks,
+// the transaction is enough as SQLite has a single writer
+func claimOutboxMessagesSqlite(limit int, now, lockUntil time.Time) ([]*OutboxMessage, error) {
+	var messages []*OutboxMessage
+
+	tx := orm.DB.Begin()
+	err := tx.Where("status = ? AND next_attempt_at <= ?", OutboxStatusPending, now).
+		Order("id").Limit(limit).Find(&messages).Error
+	if err != nil || len(messages) == 0 {
+		tx.Rollback()
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+		m.NextAttemptAt = lockUntil
+	}
+
+	err = tx.Model(&OutboxMessage{}).Where("id IN (?)", ids).UpdateColumn("next_attempt_at", lockUntil).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return messages, tx.Commit().Error
+}
+
+func getDeadOutboxMessages(clientID string, limit int) []*OutboxMessage {
+	var messages []*OutboxMessage
+	db := orm.DB.Where("status = ?", OutboxStatusDead)
+	if clientID != "" {
+		db = db.Where("client_id = ?", clientID)
+	}
+	db.Order("id desc").Limit(limit).Find(&messages)
+
+	return messages
+}
@@ -4,12 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
 	"github.com/retailcrm/api-client-go/v5"
 )
 
+func getRepository(c *gin.Context) ConnectionRepository {
+	return c.MustGet("repository").(ConnectionRepository)
+}
+
+func getWorkersManager(c *gin.Context) *WorkersManager {
+	return c.MustGet("workers").(*WorkersManager)
+}
+
 func connectHandler(c *gin.Context) {
 	res := struct {
 		Conn   Connection
@@ -25,6 +35,7 @@ func connectHandler(c *gin.Context) {
 }
 
 func botSettingsHandler(c *gin.Context) {
+	repo := getRepository(c)
 	jm := map[string]string{}
 
 	if err := c.ShouldBindJSON(&jm); err != nil {
@@ -32,24 +43,46 @@ func botSettingsHandler(c *gin.Context) {
 		return
 	}
 
-	conn := getConnection(jm["client_id"])
+	if !sessionAllows(c, jm["client_id"]) {
+		return
+	}
+
+	conn := repo.Get(jm["client_id"])
+	prev := *conn
 	conn.Lang = jm["lang"]
 	conn.Currency = jm["currency"]
+	conn.RealtimeStock = jm["realtime_stock"] == "true"
 
-	err := conn.saveConnection()
+	err := repo.SetBotSettings(conn)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	wm.setWorker(conn)
+	auditConnection(repo, AuditSourceUI, "bot_settings", &prev, conn)
+
+	references.invalidate(conn.ClientID)
+	products.invalidate(conn.ClientID)
+	getWorkersManager(c).setWorker(conn)
 
 	c.JSON(http.StatusOK, gin.H{"msg": getLocalizedMessage("successful")})
 }
 
 func settingsHandler(c *gin.Context) {
 	uid := c.Param("uid")
-	p := getConnection(uid)
+
+	s, err := getSession(c)
+	if err != nil || s.ClientID != uid {
+		if !checkSettingsLink(c, uid) {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		s = newSession(uid)
+		setSessionCookie(c, s)
+	}
+
+	p := getRepository(c).Get(uid)
 	if p.ID == 0 {
 		c.Redirect(http.StatusFound, "/")
 		return
@@ -61,21 +94,27 @@ func settingsHandler(c *gin.Context) {
 		Year         int
 		LangCode     []string
 		CurrencyCode map[string]string
+		CSRFToken    string
 	}{
 		p,
 		getLocale(),
 		time.Now().Year(),
 		[]string{"en", "ru", "es"},
 		currency,
+		s.CSRFToken(),
 	}
 
 	c.HTML(200, "form", res)
 }
 
 func saveHandler(c *gin.Context) {
+	repo := getRepository(c)
 	conn := c.MustGet("connection").(Connection)
+	if !sessionAllows(c, conn.ClientID) {
+		return
+	}
 
-	_, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
+	client, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
 	if err != nil {
 		if code == http.StatusInternalServerError {
 			c.Error(err)
@@ -85,21 +124,42 @@ func saveHandler(c *gin.Context) {
 		return
 	}
 
-	err = conn.saveConnection()
+	prev := repo.Get(conn.ClientID)
+
+	err = repo.Save(&conn)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	wm.setWorker(&conn)
+	stored := repo.Get(conn.ClientID)
+	if err := refreshSettingsLink(repo, client, stored); err != nil {
+		withFields(logger, LogFields{"client_id": stored.ClientID, "crm_url": stored.APIURL}).
+			Warningf("save: settings link is not refreshed: %v", err)
+	}
+
+	if stored.Broken {
+		stored.Broken = false
+		if err := repo.SetBroken(stored); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	auditConnection(repo, AuditSourceUI, "save", prev, stored)
+
+	references.invalidate(conn.ClientID)
+	products.invalidate(conn.ClientID)
+	getWorkersManager(c).setWorker(stored)
 
 	c.JSON(http.StatusOK, gin.H{"msg": getLocalizedMessage("successful")})
 }
 
 func createHandler(c *gin.Context) {
+	repo := getRepository(c)
 	conn := c.MustGet("connection").(Connection)
 
-	cl := getConnectionByURL(conn.APIURL)
+	cl := repo.GetByURL(conn.APIURL)
 	if cl.ID != 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("connection_already_created")})
 		return
@@ -115,6 +175,13 @@ func createHandler(c *gin.Context) {
 		return
 	}
 
+	if deleted := repo.GetDeletedByURL(conn.APIURL); deleted.ID != 0 {
+		if err := repo.Purge(deleted.ClientID); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
 	conn.ClientID = GenerateToken()
 
 	data, status, e := client.IntegrationModuleEdit(getIntegrationModule(conn.ClientID))
@@ -145,31 +212,67 @@ func createHandler(c *gin.Context) {
 		return
 	}
 
-	err = conn.createConnection()
+	err = repo.Create(&conn)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	wm.setWorker(&conn)
+	auditConnection(repo, AuditSourceUI, "create", &Connection{}, &conn)
+
+	getWorkersManager(c).setWorker(&conn)
 
 	c.JSON(
 		http.StatusCreated,
 		gin.H{
-			"url":     "/settings/" + conn.ClientID,
+			"url":     settingsLink(conn.ClientID),
 			"message": getLocalizedMessage("successful"),
 		},
 	)
 }
 
+func uninstallHandler(c *gin.Context) {
+	repo := getRepository(c)
+	jm := map[string]string{}
+
+	if err := c.ShouldBindJSON(&jm); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !sessionAllows(c, jm["client_id"]) {
+		return
+	}
+
+	conn := repo.Get(jm["client_id"])
+	if conn.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": getLocalizedMessage("not_found_account")})
+		return
+	}
+
+	if err := uninstall(repo, getWorkersManager(c), conn, AuditSourceUI); err != nil {
+		c.Error(err)
+		return
+	}
+
+	clearSessionCookie(c)
+
+	c.JSON(http.StatusOK, gin.H{"msg": getLocalizedMessage("uninstalled"), "url": "/"})
+}
+
 func activityHandler(c *gin.Context) {
 	var (
+		repo      = getRepository(c)
 		activity  v5.Activity
 		systemUrl = c.PostForm("systemUrl")
 		clientId  = c.PostForm("clientId")
 	)
 
-	conn := getConnection(clientId)
+	conn := repo.Get(clientId)
+	if conn.ID == 0 {
+		conn = repo.GetDeleted(clientId)
+	}
+
 	if conn.ID == 0 {
 		c.AbortWithStatusJSON(http.StatusBadRequest,
 			gin.H{
@@ -191,27 +294,204 @@ func activityHandler(c *gin.Context) {
 		return
 	}
 
-	conn.Active = activity.Active && !activity.Freeze
+	if systemUrl != "" && !isCRMURL(systemUrl) {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{
+				"success": false,
+				"error":   "Wrong data",
+			},
+		)
+		return
+	}
+
+	updated := *conn
+	updated.Active = activity.Active && !activity.Freeze
 
 	if systemUrl != "" {
-		conn.APIURL = systemUrl
+		updated.APIURL = systemUrl
+		updated.NormalizeApiUrl()
+	}
+
+	// the callback is confirmed by the CRM known before, the key is never sent to the new systemUrl
+	if err := verifyActivity(conn.APIURL, conn.APIKEY, conn.ClientID, activity); err != nil {
+		withFields(logger, LogFields{"client_id": conn.ClientID, "crm_url": conn.APIURL, "system_url": systemUrl}).
+			Warningf("activity: callback rejected: %v", err)
+
+		if errorClass(err) == ErrorClassTransient {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable,
+				gin.H{
+					"success": false,
+					"error":   "Service unavailable",
+				},
+			)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{
+				"success": false,
+				"error":   "Wrong data",
+			},
+		)
+		return
+	}
+
+	// the activity of the stored CRM does not prove the new address belongs
+	// to the same account, the move has to be confirmed by the stored CRM
+	if updated.APIURL != conn.APIURL && !confirmSystemURL(conn.APIURL, updated.APIURL) {
+		withFields(logger, LogFields{"client_id": conn.ClientID, "crm_url": conn.APIURL, "system_url": systemUrl}).
+			Warningf("activity: systemUrl change is not confirmed by the stored CRM, ignored")
+		updated.APIURL = conn.APIURL
+	}
+
+	if !activity.Active {
+		if conn.DeletedAt == nil {
+			if err := uninstall(repo, getWorkersManager(c), conn, AuditSourceCRM); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
 	}
-	conn.NormalizeApiUrl()
 
-	if err := conn.setConnectionActivity(); err != nil {
+	if conn.DeletedAt != nil {
+		if err := restore(repo, conn, AuditSourceCRM); err != nil {
+			c.Error(err)
+			return
+		}
+		updated.DeletedAt = nil
+	}
+
+	if err := repo.SetActivity(&updated); err != nil {
 		c.Error(err)
 		return
 	}
 
-	if !conn.Active {
-		wm.stopWorker(conn)
+	auditConnection(repo, AuditSourceCRM, "activity", conn, &updated)
+
+	if workers := getWorkersManager(c); !updated.Active {
+		workers.stopWorker(&updated)
 	} else {
-		wm.setWorker(conn)
+		workers.setWorker(&updated)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+func outboxDeadHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messages": getDeadOutboxMessages(c.Query("client_id"), limit)})
+}
+
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func readyzHandler(c *gin.Context) {
+	checks := map[string]bool{
+		"database":     orm != nil && orm.DB.DB().Ping() == nil,
+		"translations": translationsLoaded(),
+		"workers":      getWorkersManager(c).launched(),
+	}
+
+	status := http.StatusOK
+	for _, ok := range checks {
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(status, checks)
+}
+
+func statusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"workers":     getWorkersManager(c).readiness(),
+		"connections": getWorkersManager(c).statuses(),
+	})
+}
+
+func workersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, getWorkersManager(c).readiness())
+}
+
+func cacheHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"products": products.stats()})
+}
+
+func logLevelHandler(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		var req struct {
+			Level string `json:"level"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+			return
+		}
+
+		level, err := logging.LogLevel(req.Level)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+			return
+		}
+
+		setLogLevel(level)
+		logger.Infof("log level set to %s", level)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"level": getLogLevel().String()})
+}
+
+func auditHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	c.JSON(http.StatusOK, gin.H{"records": getRepository(c).Audit(c.Param("uid"), limit)})
+}
+
+func rateLimitHandler(c *gin.Context) {
+	repo := getRepository(c)
+	var limits struct {
+		Chat       int `json:"chat"`
+		Connection int `json:"connection"`
+	}
+
+	if err := c.ShouldBindJSON(&limits); err != nil || limits.Chat < 0 || limits.Connection < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+		return
+	}
+
+	conn := repo.Get(c.Param("uid"))
+	if conn.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": getLocalizedMessage("not_found_account")})
+		return
+	}
+
+	prev := *conn
+	conn.ChatRateLimit = limits.Chat
+	conn.ConnectionRateLimit = limits.Connection
+
+	if err := repo.SetRateLimit(conn); err != nil {
+		c.Error(err)
+		return
+	}
+
+	auditConnection(repo, AuditSourceAdmin, "rate_limit", &prev, conn)
+
+	getWorkersManager(c).setWorker(conn)
+
+	c.JSON(http.StatusOK, gin.H{"msg": getLocalizedMessage("successful")})
+}
+
 func getIntegrationModule(clientId string) v5.IntegrationModule {
 	return v5.IntegrationModule{
 		Code:            config.BotInfo.Code,
@@ -229,9 +509,9 @@ func getIntegrationModule(clientId string) v5.IntegrationModule {
 			config.HTTPServer.Host,
 		),
 		AccountURL: fmt.Sprintf(
-			"https://%s/settings/%s",
+			"https://%s%s",
 			config.HTTPServer.Host,
-			clientId,
+			settingsLink(clientId),
 		),
 		Actions: map[string]string{"activity": "/actions/activity"},
 		Integrations: &v5.Integrations{
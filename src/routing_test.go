@@ -3,7 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/h2non/gock"
+	v5 "github.com/retailcrm/api-client-go/v5"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
 )
@@ -23,17 +24,22 @@ var (
 	clientID = "09385039f039irf039fkj309fj30jf3"
 )
 
+// handlers are tested with connections kept in memory, tests using the
+// database call requireDB
 func init() {
-	os.Chdir("../")
-	config = LoadConfig("config_test.yml")
-	orm = NewDb(config)
+	path := "../config_test.yml"
+	if _, err := os.Stat(path); err != nil {
+		path += ".dist"
+	}
+
+	config = LoadConfig(path)
 	logger = newLogger()
-	router = setup()
+	sessionSecret, _ = newSessionSecret(config.Session)
+	router = setup(NewMemoryConnectionRepository())
 }
 
 func TestMain(m *testing.M) {
 	c := Connection{
-		ID:       1,
 		ClientID: clientID,
 		APIKEY:   "ii32if32iuf23iufn2uifnr23inf",
 		APIURL:   crmUrl,
@@ -42,12 +48,8 @@ func TestMain(m *testing.M) {
 		Active:   true,
 	}
 
-	orm.DB.Delete(Connection{}, "id > ?", 0)
-
-	c.createConnection()
-	retCode := m.Run()
-	orm.DB.Delete(Connection{}, "id > ?", 0)
-	os.Exit(retCode)
+	wm.repo.Create(&c)
+	os.Exit(m.Run())
 }
 
 func TestRouting_connectHandler(t *testing.T) {
@@ -62,8 +64,20 @@ func TestRouting_connectHandler(t *testing.T) {
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
 }
 
+func TestRouting_healthzHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+}
+
 func TestRouting_settingsHandler(t *testing.T) {
-	req, err := http.NewRequest("GET", "/settings/"+clientID, nil)
+	req, err := http.NewRequest("GET", settingsLink(clientID), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,6 +87,27 @@ func TestRouting_settingsHandler(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code,
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.Contains(t, rr.Header().Get("Set-Cookie"), sessionCookie)
+}
+
+func TestRouting_settingsHandlerUnsigned(t *testing.T) {
+	req, err := http.NewRequest("GET", "/settings/"+clientID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusFound, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusFound))
+}
+
+// withSession adds session cookie and CSRF token of the connection to req
+func withSession(req *http.Request, uid string) {
+	s := newSession(uid)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: s.encode()})
+	req.Header.Set(csrfHeader, s.CSRFToken())
 }
 
 func TestRouting_saveHandler(t *testing.T) {
@@ -83,6 +118,15 @@ func TestRouting_saveHandler(t *testing.T) {
 		Reply(200).
 		BodyString(`{"success": true, "credentials": ["/api/integration-modules/{code}", "/api/integration-modules/{code}/edit", "/api/reference/payment-types", "/api/reference/delivery-types", "/api/store/products"]}`)
 
+	gock.New(crmUrl).
+		Post("/api/v5/integration-modules/" + config.BotInfo.Code + "/edit").
+		Reply(200).
+		BodyString(`{"success": true, "info": {}}`)
+
+	products = NewProductCache(config.Cache)
+	defer func() { products = nil }()
+	products.put(clientID, "T-shirt", []v5.Product{{ID: 1}})
+
 	req, err := http.NewRequest("POST", "/save/",
 		strings.NewReader(fmt.Sprintf(
 			`{"clientId": "%s",
@@ -95,12 +139,97 @@ func TestRouting_saveHandler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	withSession(req, clientID)
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code,
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.False(t, gock.IsPending(), "settings link is not refreshed")
+	_, _, ok := products.get(clientID, "T-shirt")
+	assert.False(t, ok, "cached products of the previous credentials must be dropped")
+
+	records := wm.repo.Audit(clientID, 1)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "save", records[0].Action)
+		assert.Equal(t, AuditSourceUI, records[0].Source)
+		assert.NotContains(t, string(records[0].Changes.RawMessage), "test\"")
+	}
+}
+
+func TestRouting_auditHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/admin/connections/"+clientID+"/audit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(config.Admin.Login, config.Admin.Password)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.Contains(t, rr.Body.String(), `"records"`)
+}
+
+func TestRouting_botSettingsHandler(t *testing.T) {
+	repo := NewMemoryConnectionRepository()
+	repo.Create(&Connection{ClientID: clientID, APIURL: crmUrl, Lang: "ru"})
+
+	req, err := http.NewRequest("POST", "/bot-settings/", strings.NewReader(fmt.Sprintf(
+		`{"client_id": "%s", "lang": "en", "currency": "USD", "realtime_stock": "true"}`,
+		clientID,
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSession(req, clientID)
+
+	rr := httptest.NewRecorder()
+	newRouter(repo, NewWorkersManager(repo)).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+
+	conn := repo.Get(clientID)
+	assert.Equal(t, "en", conn.Lang)
+	assert.Equal(t, "USD", conn.Currency)
+	assert.True(t, conn.RealtimeStock)
+
+	records := repo.Audit(clientID, 1)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "bot_settings", records[0].Action)
+	}
+}
+
+func TestRouting_saveHandlerSession(t *testing.T) {
+	body := fmt.Sprintf(`{"clientId": "%s", "api_url": "%s", "api_key": "test"}`, clientID, crmUrl)
+
+	cases := []struct {
+		prepare func(req *http.Request)
+		code    int
+	}{
+		{func(req *http.Request) {}, http.StatusUnauthorized},
+		{func(req *http.Request) {
+			withSession(req, clientID)
+			req.Header.Set(csrfHeader, "wrong")
+		}, http.StatusForbidden},
+		{func(req *http.Request) { withSession(req, "another") }, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("POST", "/save/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.prepare(req)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.code, rr.Code)
+	}
 }
 
 func TestRouting_activityHandler(t *testing.T) {
@@ -110,25 +239,64 @@ func TestRouting_activityHandler(t *testing.T) {
 		t.Fatal("worker don`t start")
 	}
 
-	data := []url.Values{
+	cases := []struct {
+		data   url.Values
+		moved  bool
+		apiURL string
+	}{
 		{
-			"clientId":  {clientID},
-			"activity":  {`{"active": false, "freeze": false}`},
-			"systemUrl": {crmUrl},
+			data: url.Values{
+				"clientId":  {clientID},
+				"activity":  {`{"active": false, "freeze": false}`},
+				"systemUrl": {crmUrl},
+			},
+			apiURL: crmUrl,
 		},
 		{
-			"clientId":  {clientID},
-			"activity":  {`{"active": true, "freeze": false}`},
-			"systemUrl": {crmUrl},
+			data: url.Values{
+				"clientId":  {clientID},
+				"activity":  {`{"active": true, "freeze": false}`},
+				"systemUrl": {crmUrl},
+			},
+			apiURL: crmUrl,
 		},
 		{
-			"clientId":  {clientID},
-			"activity":  {`{"active": true, "freeze": false}`},
-			"systemUrl": {"http://change.retailcrm.ru"},
+			data: url.Values{
+				"clientId":  {clientID},
+				"activity":  {`{"active": true, "freeze": false}`},
+				"systemUrl": {"https://other.retailcrm.ru"},
+			},
+			apiURL: crmUrl,
+		},
+		{
+			data: url.Values{
+				"clientId":  {clientID},
+				"activity":  {`{"active": true, "freeze": false}`},
+				"systemUrl": {"https://change.retailcrm.ru"},
+			},
+			moved:  true,
+			apiURL: "https://change.retailcrm.ru",
 		},
 	}
 
-	for _, v := range data {
+	defer gock.Off()
+
+	for _, c := range cases {
+		v := c.data
+
+		// activity is confirmed by the CRM stored before the change of systemUrl
+		gock.New(crmUrl).
+			Get("/api/v5/integration-modules/" + config.BotInfo.Code).
+			Reply(200).
+			BodyString(fmt.Sprintf(`{"success": true, "integrationModule": {"clientId": "%s", %s}}`,
+				clientID, strings.Trim(v.Get("activity"), "{}")))
+
+		if c.moved {
+			gock.New(crmUrl).
+				Get("/").
+				Reply(http.StatusMovedPermanently).
+				SetHeader("Location", v.Get("systemUrl")+"/")
+		}
 
 		req, err := http.NewRequest("POST", "/actions/activity", strings.NewReader(v.Encode()))
 		if err != nil {
@@ -155,14 +323,94 @@ func TestRouting_activityHandler(t *testing.T) {
 			t.Error("worker don`t stop")
 		}
 
-		if ok && w.connection.APIURL != v.Get("systemUrl") {
-			t.Error("fail update systemUrl")
+		stored := wm.repo.Get(clientID)
+		if stored.ID == 0 {
+			stored = wm.repo.GetDeleted(clientID)
 		}
+		assert.Equal(t, c.apiURL, stored.APIURL, v.Get("systemUrl"))
+		if ok {
+			assert.Equal(t, c.apiURL, w.getConnection().APIURL, v.Get("systemUrl"))
+		}
+	}
+}
+
+func TestRouting_activityHandlerRejected(t *testing.T) {
+	defer gock.Off()
+
+	apiURL := wm.repo.Get(clientID).APIURL
+
+	gock.New(apiURL).
+		Get("/api/v5/integration-modules/" + config.BotInfo.Code).
+		Reply(200).
+		BodyString(fmt.Sprintf(`{"success": true, "integrationModule": {"clientId": "%s", "active": true}}`, clientID))
+
+	data := []url.Values{
+		{
+			"clientId":  {clientID},
+			"activity":  {`{"active": true, "freeze": false}`},
+			"systemUrl": {"https://evil.example.com"},
+		},
+		{
+			"clientId":  {clientID},
+			"activity":  {`{"active": true, "freeze": false}`},
+			"systemUrl": {"https://shop.retailcrm.ru.evil.com"},
+		},
+		{
+			"clientId":  {clientID},
+			"activity":  {`{"active": true, "freeze": false}`},
+			"systemUrl": {"https://evil.com/?https://a.retailcrm.ru"},
+		},
+		{
+			"clientId":  {clientID},
+			"activity":  {`{"active": false, "freeze": false}`},
+			"systemUrl": {crmUrl},
+		},
+	}
+
+	for _, v := range data {
+		req, err := http.NewRequest("POST", "/actions/activity", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, v.Get("systemUrl"))
+	}
+
+	assert.Equal(t, apiURL, wm.repo.Get(clientID).APIURL)
+}
+
+func TestRouting_uninstallHandler(t *testing.T) {
+	req, err := http.NewRequest("POST", "/uninstall/", strings.NewReader(fmt.Sprintf(`{"client_id": "%s"}`, clientID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSession(req, clientID)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+
+	_, ok := wm.workers[clientID]
+	assert.False(t, ok)
+	assert.Equal(t, 0, wm.repo.Get(clientID).ID)
+
+	conn := wm.repo.GetDeleted(clientID)
+	if assert.NotEqual(t, 0, conn.ID) {
+		wm.repo.Restore(conn)
+		conn.Active = true
+		wm.repo.SetActivity(conn)
 	}
 }
 
 func TestTranslate(t *testing.T) {
-	files, err := ioutil.ReadDir("translate")
+	files, err := fs.ReadDir(assets, "translate")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,7 +421,7 @@ func TestTranslate(t *testing.T) {
 	for _, f := range files {
 		mt := make(map[string]string)
 		if !f.IsDir() {
-			yamlFile, err := ioutil.ReadFile("translate/" + f.Name())
+			yamlFile, err := fs.ReadFile(assets, "translate/"+f.Name())
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"os"
 	"os/signal"
@@ -9,8 +10,7 @@ import (
 	"github.com/getsentry/raven-go"
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
-	_ "github.com/golang-migrate/migrate/database/postgres"
-	_ "github.com/golang-migrate/migrate/source/file"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func init() {
@@ -23,7 +23,7 @@ func init() {
 
 var (
 	sentry *raven.Client
-	wm     = NewWorkersManager()
+	wm     *WorkersManager
 )
 
 // RunCommand struct
@@ -35,13 +35,31 @@ func (x *RunCommand) Execute(args []string) error {
 	orm = NewDb(config)
 	logger = newLogger()
 
-	go start()
+	var err error
+	if keyRing, err = NewKeyRing(config.Encryption); err != nil {
+		return err
+	}
+
+	if sessionSecret, err = newSessionSecret(config.Session); err != nil {
+		return err
+	}
+
+	shutdownTracing, err := setupTracing(config.Tracing)
+	if err != nil {
+		logger.Errorf("tracing: %v", err)
+		shutdownTracing = func() {}
+	}
+
+	router := setup(NewGormConnectionRepository(orm))
+	go start(router)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c)
 	for sig := range c {
 		switch sig {
 		case os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM:
+			wm.stopCluster()
+			shutdownTracing()
 			orm.DB.Close()
 			return nil
 		default:
@@ -51,16 +69,31 @@ func (x *RunCommand) Execute(args []string) error {
 	return nil
 }
 
-func start() {
-	router := setup()
+func start(router *gin.Engine) {
+	go dedup.purge()
+	go purgeUninstalled(wm.repo)
+	go outbox.run()
 	startWS()
 	router.Run(config.HTTPServer.Listen)
 }
 
-func setup() *gin.Engine {
+func setup(repo ConnectionRepository) *gin.Engine {
+	assets = newAssets(config.AssetsDir)
 	loadTranslateFile()
 	setValidation()
+	dedup = NewDeduplicator(config.Dedup)
+	wm = NewWorkersManager(repo)
+	outbox = NewOutbox(config.Outbox, repo)
+	references = NewReferenceCache(config.Cache)
+	products = NewProductCache(config.Cache)
+	sentry, _ = raven.New(config.SentryDSN)
 
+	return newRouter(repo, wm)
+}
+
+// newRouter returns router with handlers using repo for connections and
+// workers for their workers
+func newRouter(repo ConnectionRepository, workers *WorkersManager) *gin.Engine {
 	if config.Debug == false {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -73,10 +106,13 @@ func setup() *gin.Engine {
 
 	r.HTMLRender = createHTMLRender()
 
-	r.Static("/static", "./static")
+	r.StaticFS("/static", newStaticFileSystem())
 
+	r.Use(TracingMiddleware())
 	r.Use(func(c *gin.Context) {
 		setLocale(c.GetHeader("Accept-Language"))
+		c.Set("repository", repo)
+		c.Set("workers", workers)
 	})
 
 	errorHandlers := []ErrorHandlerFunc{
@@ -84,7 +120,6 @@ func setup() *gin.Engine {
 		ErrorResponseHandler(),
 	}
 
-	sentry, _ = raven.New(config.SentryDSN)
 	if sentry != nil {
 		errorHandlers = append(errorHandlers, ErrorCaptureHandler(sentry, true))
 	}
@@ -93,18 +128,34 @@ func setup() *gin.Engine {
 
 	r.GET("/", checkAccountForRequest(), connectHandler)
 	r.Any("/settings/:uid", settingsHandler)
-	r.POST("/save/", checkConnectionForRequest(), saveHandler)
+	r.POST("/save/", checkSessionForRequest(), checkConnectionForRequest(), saveHandler)
 	r.POST("/create/", checkConnectionForRequest(), createHandler)
-	r.POST("/bot-settings/", botSettingsHandler)
+	r.POST("/bot-settings/", checkSessionForRequest(), botSettingsHandler)
+	r.POST("/uninstall/", checkSessionForRequest(), uninstallHandler)
 	r.POST("/actions/activity", activityHandler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readyzHandler)
+
+	if config.Admin.Password != "" {
+		admin := r.Group("/admin", gin.BasicAuth(gin.Accounts{config.Admin.Login: config.Admin.Password}))
+		admin.GET("/outbox/dead", outboxDeadHandler)
+		admin.GET("/workers", workersHandler)
+		admin.GET("/status", statusHandler)
+		admin.GET("/log-level", logLevelHandler)
+		admin.PUT("/log-level", logLevelHandler)
+		admin.GET("/cache", cacheHandler)
+		admin.PUT("/connections/:uid/rate-limit", rateLimitHandler)
+		admin.GET("/connections/:uid/audit", auditHandler)
+	}
 
 	return r
 }
 
 func createHTMLRender() multitemplate.Renderer {
 	r := multitemplate.NewRenderer()
-	r.AddFromFiles("home", "templates/layout.html", "templates/home.html")
-	r.AddFromFiles("form", "templates/layout.html", "templates/form.html")
+	r.Add("home", template.Must(template.ParseFS(assets, "templates/layout.html", "templates/home.html")))
+	r.Add("form", template.Must(template.ParseFS(assets, "templates/layout.html", "templates/form.html")))
 	return r
 }
 
@@ -134,10 +185,18 @@ func checkConnectionForRequest() gin.HandlerFunc {
 }
 
 func startWS() {
-	res := getActiveConnection()
-	if len(res) > 0 {
-		for _, v := range res {
-			wm.setWorker(v)
-		}
+	var pending []*Worker
+	if config.Cluster.Enabled {
+		wm.cluster = NewCluster(config.Cluster)
+		pending = wm.balance()
+		go wm.runCluster()
+	} else {
+		pending = wm.startWorkers(wm.repo.Active())
 	}
+
+	go func() {
+		wm.launch(pending)
+		wm.markStarted()
+	}()
+	go wm.runLinkRefresh()
 }
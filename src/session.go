@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie = "mg_bot_session"
+	csrfHeader    = "X-CSRF-Token"
+
+	defaultLinkTTL    = 365 * 24 * time.Hour
+	defaultSessionTTL = time.Hour
+)
+
+var (
+	sessionSecret []byte
+
+	errSessionInvalid = errors.New("session is invalid")
+	errSessionExpired = errors.New("session is expired")
+)
+
+// Session of the account owner editing settings of the connection
+type Session struct {
+	ClientID  string
+	ExpiresAt time.Time
+	Nonce     string
+}
+
+// newSessionSecret returns the configured secret, it is required as settings
+// links stored in the CRM must stay valid after restart and on every instance
+func newSessionSecret(c SessionConfig) ([]byte, error) {
+	if c.Secret == "" {
+		return nil, errors.New("session: secret is not configured")
+	}
+
+	return []byte(c.Secret), nil
+}
+
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(strings.Join(parts, "|")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSign(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(parts...)))
+}
+
+func linkTTL() time.Duration {
+	if config.Session.LinkTTL > 0 {
+		return time.Duration(config.Session.LinkTTL) * time.Second
+	}
+
+	return defaultLinkTTL
+}
+
+func sessionTTL() time.Duration {
+	if config.Session.TTL > 0 {
+		return time.Duration(config.Session.TTL) * time.Second
+	}
+
+	return defaultSessionTTL
+}
+
+// settingsLink returns path of the settings page signed for the connection
+func settingsLink(clientID string) string {
+	expires := strconv.FormatInt(time.Now().Add(linkTTL()).Unix(), 10)
+
+	return fmt.Sprintf(
+		"/settings/%s?expires=%s&signature=%s",
+		clientID,
+		expires,
+		sign("link", clientID, expires),
+	)
+}
+
+// checkSettingsLink reports whether the settings page has been opened by
+// the signed link which has not expired yet
+func checkSettingsLink(c *gin.Context, clientID string) bool {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return checkSign(c.Query("signature"), "link", clientID, c.Query("expires"))
+}
+
+func newSession(clientID string) *Session {
+	return &Session{
+		ClientID:  clientID,
+		ExpiresAt: time.Now().Add(sessionTTL()),
+		Nonce:     GenerateToken(),
+	}
+}
+
+// CSRFToken returns token expected in the X-CSRF-Token header of the requests
+// changing settings
+func (s *Session) CSRFToken() string {
+	return sign("csrf", s.ClientID, s.Nonce)
+}
+
+func (s *Session) encode() string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join([]string{
+		s.ClientID,
+		strconv.FormatInt(s.ExpiresAt.Unix(), 10),
+		s.Nonce,
+	}, "|")))
+
+	return payload + "." + sign("session", payload)
+}
+
+func parseSession(value string) (*Session, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !checkSign(parts[1], "session", parts[0]) {
+		return nil, errSessionInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return nil, errSessionInvalid
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+
+	s := &Session{ClientID: fields[0], ExpiresAt: time.Unix(expires, 0), Nonce: fields[2]}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errSessionExpired
+	}
+
+	return s, nil
+}
+
+func setSessionCookie(c *gin.Context, s *Session) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.encode(),
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		Secure:   !config.Debug,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   !config.Debug,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func getSession(c *gin.Context) (*Session, error) {
+	value, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+
+	return parseSession(value)
+}
+
+// checkSessionForRequest rejects requests without valid session or CSRF token
+func checkSessionForRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, err := getSession(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": getLocalizedMessage("session_expired")})
+			return
+		}
+
+		if !hmac.Equal([]byte(c.GetHeader(csrfHeader)), []byte(s.CSRFToken())) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": getLocalizedMessage("session_expired")})
+			return
+		}
+
+		c.Set("session", s)
+	}
+}
+
+// sessionAllows reports whether session of the request belongs to the
+// connection, the request is aborted otherwise
+func sessionAllows(c *gin.Context, clientID string) bool {
+	if s, ok := c.MustGet("session").(*Session); ok && clientID != "" && s.ClientID == clientID {
+		return true
+	}
+
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": getLocalizedMessage("session_expired")})
+
+	return false
+}
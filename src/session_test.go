@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/gock"
+	"github.com/retailcrm/api-client-go/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_parseSession(t *testing.T) {
+	s := newSession(clientID)
+
+	parsed, err := parseSession(s.encode())
+	if assert.NoError(t, err) {
+		assert.Equal(t, s.ClientID, parsed.ClientID)
+		assert.Equal(t, s.CSRFToken(), parsed.CSRFToken())
+	}
+
+	_, err = parseSession(strings.Replace(s.encode(), ".", ".0", 1))
+	assert.Equal(t, errSessionInvalid, err)
+
+	s.ExpiresAt = time.Now().Add(-time.Minute)
+	_, err = parseSession(s.encode())
+	assert.Equal(t, errSessionExpired, err)
+}
+
+func TestSession_checkSettingsLink(t *testing.T) {
+	check := func(link, uid string) bool {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", link, nil)
+
+		return checkSettingsLink(c, uid)
+	}
+
+	link := settingsLink(clientID)
+	assert.True(t, check(link, clientID))
+	assert.False(t, check(link, "another"))
+	assert.False(t, check("/settings/"+clientID, clientID))
+
+	u, _ := url.Parse(link)
+	q := u.Query()
+	q.Set("expires", "1")
+	u.RawQuery = q.Encode()
+	assert.False(t, check(u.String(), clientID))
+}
+
+func TestSession_refreshSettingsLink(t *testing.T) {
+	defer gock.Off()
+
+	repo := NewMemoryConnectionRepository()
+	conn := &Connection{ClientID: clientID, APIURL: crmUrl, APIKEY: "key", MGURL: "https://test.retailcrm.pro", MGToken: "token"}
+	repo.Create(conn)
+
+	gock.New(crmUrl).
+		Post("/api/v5/integration-modules/" + config.BotInfo.Code + "/edit").
+		Reply(200).
+		BodyString(`{"success": true, "info": {"mgBot": {"endpointUrl": "https://test.retailcrm.pro", "token": "new"}}}`)
+
+	assert.NoError(t, refreshSettingsLink(repo, v5.New(crmUrl, "key"), conn))
+	assert.False(t, gock.IsPending())
+	assert.Equal(t, "new", repo.Get(clientID).MGToken)
+
+	gock.New(crmUrl).
+		Post("/api/v5/integration-modules/" + config.BotInfo.Code + "/edit").
+		Reply(400).
+		BodyString(`{"success": false, "errorMsg": "Errors in the input parameters"}`)
+
+	assert.Error(t, refreshSettingsLink(repo, v5.New(crmUrl, "key"), conn))
+}
+
+func TestSession_newSessionSecret(t *testing.T) {
+	_, err := newSessionSecret(SessionConfig{})
+	assert.Error(t, err)
+
+	secret, err := newSessionSecret(SessionConfig{Secret: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), secret)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/retailcrm/api-client-go/errs"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporter     *tracetest.InMemoryExporter
+	spanExporterOnce sync.Once
+)
+
+// recordSpans installs tracer provider exporting spans to memory
+func recordSpans() *tracetest.InMemoryExporter {
+	spanExporterOnce.Do(func() {
+		spanExporter = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+
+	return spanExporter
+}
+
+func TestTracing_middleware(t *testing.T) {
+	exporter := recordSpans()
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "HTTP GET healthzHandler", spans[0].Name)
+	}
+}
+
+func TestTracing_callCRM(t *testing.T) {
+	exporter := recordSpans()
+
+	w := NewWorker(&Connection{
+		ClientID: clientID,
+		APIURL:   crmUrl,
+		MGURL:    "https://test.retailcrm.pro",
+		Active:   true,
+	}, NewMemoryConnectionRepository(), sentry, logger)
+
+	ctx, span := tracer.Start(context.Background(), "ws.event")
+	err := w.callCRM(ctx, "payment_types", func() (int, errs.Failure) {
+		return http.StatusServiceUnavailable, errs.Failure{ApiErr: "service unavailable"}
+	})
+	span.End()
+
+	assert.Error(t, err)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "crm.payment_types", spans[0].Name)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+		assert.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+)
+
+const defaultRetention = 30 * 24 * time.Hour
+
+func retention() time.Duration {
+	if config.Uninstall.Retention > 0 {
+		return time.Duration(config.Uninstall.Retention) * time.Second
+	}
+
+	return defaultRetention
+}
+
+// uninstall removes commands of the bot from MG, stops the worker and soft
+// deletes the connection, it is purged after the retention period
+func uninstall(repo ConnectionRepository, workers *WorkersManager, conn *Connection, source string) error {
+	log := withFields(logger, LogFields{"client_id": conn.ClientID, "crm_url": conn.APIURL})
+
+	if code, err := DeleteBotCommands(conn.MGURL, conn.MGToken); err != nil {
+		log.Warningf("uninstall: delete commands, status: %d, err: %v", code, err)
+	}
+
+	workers.stopWorker(conn)
+
+	prev := *conn
+	conn.Active = false
+
+	if err := repo.SetActivity(conn); err != nil {
+		return err
+	}
+
+	if err := repo.Delete(conn); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	conn.DeletedAt = &now
+
+	references.invalidate(conn.ClientID)
+	products.invalidate(conn.ClientID)
+	auditConnection(repo, source, "uninstall", &prev, conn)
+	log.Infof("uninstall: connection removed, purge after %s", retention())
+
+	return nil
+}
+
+// restore brings back connection uninstalled within the retention period
+func restore(repo ConnectionRepository, conn *Connection, source string) error {
+	if err := repo.Restore(conn); err != nil {
+		return err
+	}
+
+	conn.DeletedAt = nil
+
+	if code, err := SetBotCommand(conn.MGURL, conn.MGToken); err != nil {
+		withFields(logger, LogFields{"client_id": conn.ClientID, "crm_url": conn.APIURL}).
+			Warningf("restore: set commands, status: %d, err: %v", code, err)
+	}
+
+	auditConnection(repo, source, "restore", conn, conn)
+
+	return nil
+}
+
+// purgeUninstalled hard deletes connections which retention period has passed
+func purgeUninstalled(repo ConnectionRepository) {
+	for {
+		count, err := repo.PurgeDeleted(time.Now().Add(-retention()))
+		if err != nil {
+			logger.Errorf("uninstall: purge: %v", err)
+		} else if count > 0 {
+			logger.Infof("uninstall: %d connections purged", count)
+		}
+		time.Sleep(time.Hour)
+	}
+}
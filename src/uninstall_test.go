@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUninstall_purgeDeleted(t *testing.T) {
+	requireDB(t)
+
+	c := Connection{
+		ClientID: "purge-" + clientID,
+		APIKEY:   "ii32if32iuf23iufn2uifnr23inf",
+		APIURL:   "https://purge.retailcrm.ru",
+		MGURL:    "https://test.retailcrm.pro",
+		MGToken:  "purge-988730985u23r390rf8j3984jf32904fj",
+	}
+
+	repo := NewGormConnectionRepository(orm)
+	if err := repo.Create(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, repo.Delete(&c))
+
+	count, err := repo.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.NotEqual(t, 0, repo.GetDeleted(c.ClientID).ID)
+
+	count, err = repo.PurgeDeleted(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 0, repo.GetDeleted(c.ClientID).ID)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,8 @@ import (
 	"github.com/retailcrm/api-client-go/v5"
 )
 
+var errActivityMismatch = errors.New("activity does not match the integration module")
+
 // GenerateToken function
 func GenerateToken() string {
 	c := atomic.AddUint32(&tokenCounter, 1)
@@ -46,6 +49,53 @@ func getAPIClient(url, key string) (*v5.Client, error, int) {
 	return client, nil, 0
 }
 
+// verifyActivity confirms activity reported to the callback by the state of
+// the integration module requested from the CRM with the stored API key
+func verifyActivity(url, key, clientID string, activity v5.Activity) error {
+	data, status, e := v5.New(url, key).IntegrationModule(config.BotInfo.Code)
+	if err := newCRMError(status, e); err != nil {
+		return err
+	}
+
+	m := data.IntegrationModule
+	if m == nil || m.ClientID != clientID || m.Active != activity.Active || m.Freeze != activity.Freeze {
+		return errActivityMismatch
+	}
+
+	return nil
+}
+
+// confirmSystemURL reports whether the CRM at the stored address redirects
+// to systemURL, i.e. the account has moved there. The request carries no
+// credentials.
+func confirmSystemURL(storedURL, systemURL string) bool {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(storedURL)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusMultipleChoices || resp.StatusCode >= http.StatusBadRequest {
+		return false
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return false
+	}
+
+	target, err := url.Parse(systemURL)
+
+	return err == nil && location.Scheme == "https" && strings.EqualFold(location.Host, target.Host)
+}
+
 func checkCredentials(credential []string) []string {
 	rc := make([]string, len(botCredentials))
 	copy(rc, botCredentials)
@@ -64,3 +114,27 @@ func checkCredentials(credential []string) []string {
 
 	return rc
 }
+
+// refreshSettingsLink edits the integration module of the connection in the
+// CRM with a freshly signed settings link. MG bot credentials returned by the
+// CRM are stored when they differ from the connection.
+func refreshSettingsLink(repo ConnectionRepository, client *v5.Client, conn *Connection) error {
+	data, status, e := client.IntegrationModuleEdit(getIntegrationModule(conn.ClientID))
+	if err := newCRMError(status, e); err != nil {
+		return err
+	}
+
+	if status >= http.StatusBadRequest {
+		return fmt.Errorf("integration module edit failed with status %d", status)
+	}
+
+	info := data.Info.MgBotInfo
+	if info.Token == "" || (info.Token == conn.MGToken && info.EndpointUrl == conn.MGURL) {
+		return nil
+	}
+
+	conn.MGURL = info.EndpointUrl
+	conn.MGToken = info.Token
+
+	return repo.Save(&Connection{ClientID: conn.ClientID, MGURL: conn.MGURL, MGToken: conn.MGToken})
+}
@@ -1,15 +1,43 @@
 package main
 
 import (
+	"net/url"
 	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin/binding"
 	"gopkg.in/go-playground/validator.v9"
 )
 
-var regCommandName = regexp.MustCompile(`https://?[\da-z.-]+\.(retailcrm\.(ru|pro)|ecomlogic\.com|simlachat\.com)`)
+var (
+	regCRMHost = regexp.MustCompile(`^[\da-z-]+(\.[\da-z-]+)*$`)
+	crmDomains = []string{"retailcrm.ru", "retailcrm.pro", "ecomlogic.com", "simlachat.com"}
+)
+
+// isCRMURL reports whether raw is an https address of the CRM account: a
+// subdomain of the CRM domains without port, credentials, path or query
+func isCRMURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" ||
+		u.Opaque != "" || u.RawQuery != "" || u.Fragment != "" || strings.Trim(u.Path, "/") != "" {
+		return false
+	}
+
+	host := u.Hostname()
+	if !regCRMHost.MatchString(host) {
+		return false
+	}
+
+	for _, domain := range crmDomains {
+		if strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
 
 type defaultValidator struct {
 	once     sync.Once
@@ -61,5 +89,5 @@ func setValidation() {
 }
 
 func validateCrmURL(field validator.FieldLevel) bool {
-	return regCommandName.Match([]byte(field.Field().Interface().(string)))
+	return isCRMURL(field.Field().Interface().(string))
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidator_isCRMURL(t *testing.T) {
+	valid := []string{
+		"https://test.retailcrm.ru",
+		"https://test.retailcrm.pro/",
+		"https://shop.ecomlogic.com",
+		"https://a.b.simlachat.com",
+	}
+
+	for _, u := range valid {
+		assert.True(t, isCRMURL(u), u)
+	}
+
+	invalid := []string{
+		"",
+		"http://test.retailcrm.ru",
+		"https://retailcrm.ru",
+		"https://shop.retailcrm.ru.evil.com",
+		"https://evil.com/?https://a.retailcrm.ru",
+		"https://evil.com/https://a.retailcrm.ru",
+		"https://evil.com#.retailcrm.ru",
+		"https://a.retailcrm.ru@evil.com",
+		"https://test.retailcrm.ru:8443",
+		"https://test.retailcrm.ru/api",
+		"https://evilretailcrm.ru",
+	}
+
+	for _, u := range invalid {
+		assert.False(t, isCRMURL(u), u)
+	}
+}
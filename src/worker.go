@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getsentry/raven-go"
@@ -16,6 +21,8 @@ import (
 	"github.com/retailcrm/api-client-go/errs"
 	v5 "github.com/retailcrm/api-client-go/v5"
 	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/text/language"
 )
 
@@ -25,6 +32,26 @@ const (
 	CommandProduct  = "/product"
 )
 
+const (
+	WorkerStatePending int32 = iota
+	WorkerStateConnecting
+	WorkerStateConnected
+)
+
+var workerStateNames = map[int32]string{
+	WorkerStatePending:    "pending",
+	WorkerStateConnecting: "connecting",
+	WorkerStateConnected:  "connected",
+}
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	startTimeout    = 30 * time.Second
+)
+
+const defaultAuthFailures = 3
+
 var (
 	events         = []string{v1.WsEventMessageNew}
 	msgLen         = 2000
@@ -41,6 +68,7 @@ var (
 
 type Worker struct {
 	connection *Connection
+	repo       ConnectionRepository
 	mutex      sync.RWMutex
 	localizer  *i18n.Localizer
 
@@ -49,11 +77,23 @@ type Worker struct {
 
 	mgClient  *v1.MgClient
 	crmClient *v5.Client
+	limiter   *RateLimiter
+	breaker   *CircuitBreaker
 
-	close bool
+	state        int32
+	started      chan struct{}
+	startOnce    sync.Once
+	authFailures int32
+
+	statusMutex sync.Mutex
+	lastEventAt time.Time
+	lastError   string
+	lastErrorAt time.Time
+
+	close atomic.Bool
 }
 
-func NewWorker(conn *Connection, sentry *raven.Client, logger *logging.Logger) *Worker {
+func NewWorker(conn *Connection, repo ConnectionRepository, sentry *raven.Client, logger *logging.Logger) *Worker {
 	crmClient := v5.New(conn.APIURL, conn.APIKEY)
 	mgClient := v1.New(conn.MGURL, conn.MGToken)
 	if config.Debug {
@@ -61,46 +101,230 @@ func NewWorker(conn *Connection, sentry *raven.Client, logger *logging.Logger) *
 		mgClient.Debug = true
 	}
 
+	registerSecret(conn.APIKEY)
+	registerSecret(conn.MGToken)
+
 	return &Worker{
 		connection: conn,
+		repo:       repo,
 		sentry:     sentry,
 		logger:     logger,
 		localizer:  getLang(conn.Lang),
 		mgClient:   mgClient,
 		crmClient:  crmClient,
-		close:      false,
+		limiter:    NewRateLimiter(config.RateLimit, conn),
+		breaker:    NewCircuitBreaker(config.CircuitBreaker),
+		started:    make(chan struct{}),
 	}
 }
 
+func (w *Worker) setState(state int32) {
+	atomic.StoreInt32(&w.state, state)
+}
+
+func (w *Worker) getState() int32 {
+	return atomic.LoadInt32(&w.state)
+}
+
+func (w *Worker) markEvent() {
+	w.statusMutex.Lock()
+	w.lastEventAt = time.Now()
+	w.statusMutex.Unlock()
+}
+
+func (w *Worker) markError(err error) {
+	w.statusMutex.Lock()
+	w.lastError = err.Error()
+	w.lastErrorAt = time.Now()
+	w.statusMutex.Unlock()
+}
+
+// WorkerStatus struct
+type WorkerStatus struct {
+	ClientID    string     `json:"clientId"`
+	APIURL      string     `json:"apiUrl"`
+	State       string     `json:"state"`
+	Breaker     string     `json:"breaker"`
+	Broken      bool       `json:"broken"`
+	LastEventAt *time.Time `json:"lastEventAt"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+func (w *Worker) status() WorkerStatus {
+	conn := w.getConnection()
+	s := WorkerStatus{
+		ClientID: conn.ClientID,
+		APIURL:   conn.APIURL,
+		State:    workerStateNames[w.getState()],
+		Breaker:  BreakerClosed,
+		Broken:   conn.Broken,
+	}
+
+	if w.breaker != nil {
+		s.Breaker = w.breaker.State()
+	}
+
+	w.statusMutex.Lock()
+	defer w.statusMutex.Unlock()
+
+	if !w.lastEventAt.IsZero() {
+		t := w.lastEventAt
+		s.LastEventAt = &t
+	}
+
+	if w.lastError != "" {
+		t := w.lastErrorAt
+		s.LastError = w.lastError
+		s.LastErrorAt = &t
+	}
+
+	return s
+}
+
+// markStarted signals that the first connection attempt is over
+func (w *Worker) markStarted() {
+	w.startOnce.Do(func() {
+		close(w.started)
+	})
+}
+
 func (w *Worker) UpdateWorker(conn *Connection) {
-	w.mutex.RLock()
-	defer w.mutex.RUnlock()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if conn.APIURL != w.connection.APIURL || conn.APIKEY != w.connection.APIKEY || conn.Broken != w.connection.Broken {
+		atomic.StoreInt32(&w.authFailures, 0)
+	}
+
+	if conn.APIKEY != w.connection.APIKEY {
+		unregisterSecret(w.connection.APIKEY)
+		registerSecret(conn.APIKEY)
+	}
+
+	if conn.MGToken != w.connection.MGToken {
+		unregisterSecret(w.connection.MGToken)
+		registerSecret(conn.MGToken)
+	}
+
+	if conn.APIURL != w.connection.APIURL || conn.APIKEY != w.connection.APIKEY {
+		w.crmClient = v5.New(conn.APIURL, conn.APIKEY)
+		w.crmClient.Debug = config.Debug
+	}
+
+	if conn.ChatRateLimit != w.connection.ChatRateLimit || conn.ConnectionRateLimit != w.connection.ConnectionRateLimit {
+		w.limiter = NewRateLimiter(config.RateLimit, conn)
+	}
 
 	w.localizer = getLang(conn.Lang)
 	w.connection = conn
 }
 
-func (w *Worker) sendSentry(err error) {
-	tags := map[string]string{
-		"crm":        w.connection.APIURL,
-		"active":     strconv.FormatBool(w.connection.Active),
-		"lang":       w.connection.Lang,
-		"currency":   w.connection.Currency,
-		"updated_at": w.connection.UpdatedAt.String(),
+// stop makes the worker exit and releases the secrets it registered
+func (w *Worker) stop() {
+	if !w.close.CompareAndSwap(false, true) {
+		return
+	}
+
+	conn := w.getConnection()
+	unregisterSecret(conn.APIKEY)
+	unregisterSecret(conn.MGToken)
+}
+
+// getConnection returns copy of the connection, it is replaced by
+// UpdateWorker and authFailed under the lock
+func (w *Worker) getConnection() Connection {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return *w.connection
+}
+
+func (w *Worker) getCRMClient() *v5.Client {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.crmClient
+}
+
+// allow checks the command against the rate limiter of the worker, the
+// limiter is read under the lock as UpdateWorker replaces it
+func (w *Worker) allow(chatID uint64, now time.Time) (ok bool, notify bool) {
+	w.mutex.RLock()
+	limiter := w.limiter
+	w.mutex.RUnlock()
+
+	return limiter.allow(chatID, now)
+}
+
+func (w *Worker) sentryTags() map[string]string {
+	conn := w.getConnection()
+
+	return map[string]string{
+		"crm":        conn.APIURL,
+		"clientID":   conn.ClientID,
+		"active":     strconv.FormatBool(conn.Active),
+		"lang":       conn.Lang,
+		"currency":   conn.Currency,
+		"updated_at": conn.UpdatedAt.String(),
 	}
+}
+
+// log returns logger with the fields of the connection
+func (w *Worker) log() *FieldLogger {
+	conn := w.getConnection()
+
+	return withFields(w.logger, LogFields{
+		"client_id": conn.ClientID,
+		"crm_url":   conn.APIURL,
+	})
+}
+
+func (w *Worker) sendSentry(err error) {
+	w.report(w.log(), err)
+}
+
+func (w *Worker) report(log *FieldLogger, err error) {
+	w.markError(err)
+	log.Errorf("%v", err)
+	go w.sentry.CaptureError(err, w.sentryTags())
+}
+
+func (w *Worker) sendPanic(rec interface{}) {
+	recStr := fmt.Sprint(rec)
+	w.markError(fmt.Errorf("panic: %s", recStr))
+	w.log().Errorf("panic: %s\n%s", recStr, debug.Stack())
 
-	w.logger.Errorf("ws url: %s\nmgClient: %v\nerr: %v", w.crmClient.URL, w.mgClient, err)
-	go w.sentry.CaptureError(err, tags)
+	stacktrace := raven.NewStacktrace(2, 3, nil)
+	go w.sentry.CaptureMessage(recStr, w.sentryTags(), raven.NewException(errors.New(recStr), stacktrace))
+}
+
+// run executes UpWS and reports whether it was stopped by a panic
+func (w *Worker) run() (panicked bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			panicked = true
+			w.sendPanic(rec)
+		}
+	}()
+
+	w.UpWS()
+
+	return
 }
 
 type WorkersManager struct {
 	mutex   sync.RWMutex
 	workers map[string]*Worker
+	repo    ConnectionRepository
+	cluster *Cluster
+	started int32
 }
 
-func NewWorkersManager() *WorkersManager {
+func NewWorkersManager(repo ConnectionRepository) *WorkersManager {
 	return &WorkersManager{
 		workers: map[string]*Worker{},
+		repo:    repo,
 	}
 }
 
@@ -108,14 +332,23 @@ func (wm *WorkersManager) setWorker(conn *Connection) {
 	wm.mutex.Lock()
 	defer wm.mutex.Unlock()
 
-	if conn.Active {
-		worker, ok := wm.workers[conn.ClientID]
-		if ok {
-			worker.UpdateWorker(conn)
-		} else {
-			wm.workers[conn.ClientID] = NewWorker(conn, sentry, logger)
-			go wm.workers[conn.ClientID].UpWS()
+	if !conn.Active {
+		return
+	}
+
+	if conn.APIKEY == "" || conn.MGToken == "" {
+		logger.Errorf("connection %s: credentials are not available, worker is not updated", conn.ClientID)
+		return
+	}
+
+	worker, ok := wm.workers[conn.ClientID]
+	if ok {
+		worker.UpdateWorker(conn)
+	} else {
+		if wm.cluster != nil && !wm.cluster.acquire(conn.ClientID) {
+			return
 		}
+		wm.startWorker(conn)
 	}
 }
 
@@ -123,37 +356,350 @@ func (wm *WorkersManager) stopWorker(conn *Connection) {
 	wm.mutex.Lock()
 	defer wm.mutex.Unlock()
 
-	worker, ok := wm.workers[conn.ClientID]
+	wm.removeWorker(conn.ClientID)
+}
+
+// startWorkers registers workers for the connections, the returned workers
+// are to be started by launch.
+func (wm *WorkersManager) startWorkers(connections []*Connection) []*Worker {
+	wm.mutex.Lock()
+	defer wm.mutex.Unlock()
+
+	var pending []*Worker
+	for _, conn := range connections {
+		if _, ok := wm.workers[conn.ClientID]; ok || !conn.Active {
+			continue
+		}
+		if wm.cluster != nil && !wm.cluster.acquire(conn.ClientID) {
+			continue
+		}
+
+		wm.workers[conn.ClientID] = NewWorker(conn, wm.repo, sentry, logger)
+		pending = append(pending, wm.workers[conn.ClientID])
+	}
+
+	return pending
+}
+
+// launch starts the workers spread over the startup window with limited
+// concurrency and returns once each of them has made its first connection
+// attempt.
+func (wm *WorkersManager) launch(pending []*Worker) {
+	if len(pending) == 0 {
+		return
+	}
+
+	concurrency := config.Startup.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(pending)
+	}
+
+	step := time.Duration(config.Startup.Window) * time.Second / time.Duration(len(pending))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for i, w := range pending {
+		if i > 0 {
+			time.Sleep(step)
+		}
+
+		sem <- struct{}{}
+		if w.close.Load() {
+			<-sem
+			continue
+		}
+
+		go wm.supervise(w)
+		go w.refreshLink()
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			select {
+			case <-w.started:
+			case <-time.After(startTimeout):
+			}
+			<-sem
+		}(w)
+	}
+
+	wg.Wait()
+
+	r := wm.readiness()
+	logger.Infof("workers launched: %d connected, %d pending", r.Connected, r.Pending)
+}
+
+// WorkersReadiness struct
+type WorkersReadiness struct {
+	Total        int `json:"total"`
+	Connected    int `json:"connected"`
+	Pending      int `json:"pending"`
+	OpenBreakers int `json:"openBreakers"`
+}
+
+func (wm *WorkersManager) size() int {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	return len(wm.workers)
+}
+
+// markStarted records that the workers of the instance have been launched
+// on startup
+func (wm *WorkersManager) markStarted() {
+	atomic.StoreInt32(&wm.started, 1)
+}
+
+// launched reports whether the startup launch of the workers is over.
+// Workers added later by cluster rebalancing do not affect it, they are
+// reported by readiness only.
+func (wm *WorkersManager) launched() bool {
+	return atomic.LoadInt32(&wm.started) == 1
+}
+
+func (wm *WorkersManager) statuses() []WorkerStatus {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	statuses := make([]WorkerStatus, 0, len(wm.workers))
+	for _, w := range wm.workers {
+		statuses = append(statuses, w.status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ClientID < statuses[j].ClientID
+	})
+
+	return statuses
+}
+
+func (wm *WorkersManager) readiness() WorkersReadiness {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	r := WorkersReadiness{Total: len(wm.workers)}
+	for _, w := range wm.workers {
+		if w.getState() == WorkerStateConnected {
+			r.Connected++
+		} else {
+			r.Pending++
+		}
+
+		if w.breaker != nil && w.breaker.State() != BreakerClosed {
+			r.OpenBreakers++
+		}
+	}
+
+	return r
+}
+
+func (wm *WorkersManager) startWorker(conn *Connection) {
+	wm.workers[conn.ClientID] = NewWorker(conn, wm.repo, sentry, logger)
+	go wm.supervise(wm.workers[conn.ClientID])
+}
+
+// supervise restarts the worker with backoff until it is closed or returns normally
+func (wm *WorkersManager) supervise(w *Worker) {
+	delay := minRestartDelay
+
+	for !w.close.Load() {
+		started := time.Now()
+		if !w.run() {
+			return
+		}
+
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+
+		w.log().Warningf("restart ws in %s", delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+func (wm *WorkersManager) removeWorker(clientID string) {
+	worker, ok := wm.workers[clientID]
 	if ok {
-		worker.close = true
-		delete(wm.workers, conn.ClientID)
+		worker.stop()
+		delete(wm.workers, clientID)
+	}
+
+	if wm.cluster != nil {
+		wm.cluster.release(clientID)
 	}
 }
 
+// balance renews the leases of running workers, gives away connections above
+// the fair share of the instance and takes over free or expired ones, the
+// taken over workers are returned to be started by launch. Leases are
+// acquired without holding the lock, the result is applied under it.
+func (wm *WorkersManager) balance() []*Worker {
+	active := wm.repo.Active()
+	share := wm.cluster.share(len(active))
+
+	connections := make(map[string]*Connection, len(active))
+	for _, conn := range active {
+		connections[conn.ClientID] = conn
+	}
+
+	wm.mutex.RLock()
+	running := make([]string, 0, len(wm.workers))
+	for clientID := range wm.workers {
+		running = append(running, clientID)
+	}
+	wm.mutex.RUnlock()
+
+	var kept, released []string
+	for _, clientID := range running {
+		if _, ok := connections[clientID]; ok && len(kept) < share && wm.cluster.acquire(clientID) {
+			kept = append(kept, clientID)
+		} else {
+			released = append(released, clientID)
+		}
+	}
+
+	isRunning := make(map[string]bool, len(running))
+	for _, clientID := range running {
+		isRunning[clientID] = true
+	}
+
+	var taken []*Connection
+	for _, conn := range active {
+		if len(kept)+len(taken) >= share {
+			break
+		}
+		if !isRunning[conn.ClientID] && wm.cluster.acquire(conn.ClientID) {
+			taken = append(taken, conn)
+		}
+	}
+
+	wm.mutex.Lock()
+	for _, clientID := range released {
+		if worker, ok := wm.workers[clientID]; ok {
+			worker.stop()
+			delete(wm.workers, clientID)
+		}
+	}
+
+	for _, clientID := range kept {
+		if worker, ok := wm.workers[clientID]; ok {
+			worker.UpdateWorker(connections[clientID])
+		}
+	}
+
+	var pending []*Worker
+	for _, conn := range taken {
+		if _, ok := wm.workers[conn.ClientID]; ok {
+			continue
+		}
+		wm.workers[conn.ClientID] = NewWorker(conn, wm.repo, sentry, logger)
+		pending = append(pending, wm.workers[conn.ClientID])
+	}
+	wm.mutex.Unlock()
+
+	for _, clientID := range released {
+		wm.cluster.release(clientID)
+	}
+
+	return pending
+}
+
+// runLinkRefresh refreshes settings links of the running workers well
+// before the links stored in the CRM expire
+func (wm *WorkersManager) runLinkRefresh() {
+	ticker := time.NewTicker(linkTTL() / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		wm.mutex.RLock()
+		workers := make([]*Worker, 0, len(wm.workers))
+		for _, w := range wm.workers {
+			workers = append(workers, w)
+		}
+		wm.mutex.RUnlock()
+
+		for _, w := range workers {
+			if !w.close.Load() {
+				w.refreshLink()
+			}
+		}
+	}
+}
+
+func (wm *WorkersManager) runCluster() {
+	ticker := time.NewTicker(wm.cluster.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			go wm.launch(wm.balance())
+		case <-wm.cluster.stop:
+			return
+		}
+	}
+}
+
+func (wm *WorkersManager) stopCluster() {
+	if wm.cluster == nil {
+		return
+	}
+
+	wm.mutex.Lock()
+	defer wm.mutex.Unlock()
+
+	for clientID, worker := range wm.workers {
+		worker.stop()
+		delete(wm.workers, clientID)
+	}
+
+	wm.cluster.leave()
+}
+
 func (w *Worker) UpWS() {
+	defer w.markStarted()
+
+	w.setState(WorkerStateConnecting)
 	data, header, err := w.mgClient.WsMeta(events)
 	if err != nil {
 		w.sendSentry(err)
 		return
 	}
 
+	dialed := false
+
 ROOT:
 	for {
-		if w.close {
+		if w.close.Load() {
 			if config.Debug {
-				w.logger.Debug("stop ws:", w.connection.APIURL)
+				w.log().Debugf("stop ws")
 			}
 			return
 		}
+		if dialed {
+			wsReconnectsTotal.Inc()
+		}
+		dialed = true
+
 		ws, _, err := websocket.DefaultDialer.Dial(data, header)
 		if err != nil {
+			w.setState(WorkerStateConnecting)
+			w.markStarted()
 			w.sendSentry(err)
 			time.Sleep(1000 * time.Millisecond)
 			continue ROOT
 		}
 
+		w.setState(WorkerStateConnected)
+		w.markStarted()
+
 		if config.Debug {
-			w.logger.Info("start ws: ", w.crmClient.URL)
+			w.log().Infof("start ws")
 		}
 
 		for {
@@ -162,70 +708,324 @@ ROOT:
 			if err != nil {
 				w.sendSentry(err)
 				if websocket.IsUnexpectedCloseError(err) {
+					w.setState(WorkerStateConnecting)
 					continue ROOT
 				}
 				continue
 			}
 
-			if w.close {
+			if w.close.Load() {
 				if config.Debug {
-					w.logger.Debug("stop ws:", w.connection.APIURL)
+					w.log().Debugf("stop ws")
 				}
 				return
 			}
 
-			var eventData v1.WsEventMessageNewData
-			err = json.Unmarshal(wsEvent.Data, &eventData)
-			if err != nil {
-				w.sendSentry(err)
-				continue
-			}
+			w.handleEvent(wsEvent)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
 
-			if eventData.Message.Type != "command" {
-				continue
-			}
+// handleEvent answers the command from the event, a panic is recovered so
+// that one bad message does not stop the worker.
+func (w *Worker) handleEvent(wsEvent v1.WsEvent) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			w.sendPanic(rec)
+		}
+	}()
 
-			msg, msgProd, err := w.execCommand(eventData.Message.Content)
-			if err != nil {
-				w.sendSentry(err)
-				msg = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "incorrect_key"})
-			}
+	w.markEvent()
+
+	// the event is handled with the connection it was received for, updates
+	// replace the connection and its localizer under the lock
+	w.mutex.RLock()
+	conn, localizer := *w.connection, w.localizer
+	w.mutex.RUnlock()
+
+	ctx, span := tracer.Start(context.Background(), "ws.event", trace.WithAttributes(
+		attribute.String("ws.event_type", wsEvent.Type),
+		attribute.String("client_id", conn.ClientID),
+	))
+	defer span.End()
+
+	var eventData v1.WsEventMessageNewData
+	err := json.Unmarshal(wsEvent.Data, &eventData)
+	if err != nil {
+		span.RecordError(err)
+		w.sendSentry(err)
+		return
+	}
+
+	if eventData.Message.Type != "command" {
+		return
+	}
+
+	if dedup != nil && dedup.seen(conn.ClientID, eventData.Message.ID) {
+		return
+	}
+
+	command, _, _ := parseCommand(eventData.Message.Content)
+	if command == "" {
+		command = "unknown"
+	}
+
+	log := w.log().With(LogFields{
+		"chat_id": eventData.Message.ChatID,
+		"command": command,
+	})
+	if conn.Broken {
+		commandsTotal.WithLabelValues(command, "ignored").Inc()
+		log.Debugf("connection is broken, command ignored")
+		return
+	}
+
+	log.Debugf("command received")
+	span.SetAttributes(
+		attribute.Int64("chat_id", int64(eventData.Message.ChatID)),
+		attribute.String("command", command),
+	)
+
+	if ok, notify := w.allow(eventData.Message.ChatID, time.Now()); !ok {
+		commandsTotal.WithLabelValues(command, "rate_limited").Inc()
+		log.Infof("command rate limited")
+		span.SetAttributes(attribute.String("outcome", "rate_limited"))
+		if notify {
+			w.send(ctx, v1.MessageSendRequest{
+				Type:    v1.MsgTypeText,
+				Scope:   v1.MessageScopePrivate,
+				ChatID:  eventData.Message.ChatID,
+				Content: localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "too_many_requests"}),
+			})
+		}
+		return
+	}
 
-			msgSend := v1.MessageSendRequest{
-				Scope:  v1.MessageScopePrivate,
-				ChatID: eventData.Message.ChatID,
+	msg, msgProd, err := w.execCommand(ctx, &conn, localizer, eventData.Message.Content)
+	if err == errBreakerOpen {
+		commandsTotal.WithLabelValues(command, "unavailable").Inc()
+		span.SetAttributes(attribute.String("outcome", "unavailable"))
+	} else {
+		commandsTotal.WithLabelValues(command, outcome(err)).Inc()
+		span.SetAttributes(attribute.String("outcome", outcome(err)))
+	}
+
+	if errorClass(err) == ErrorClassAuth {
+		if w.authFailed(log) {
+			return
+		}
+	} else if err == nil {
+		atomic.StoreInt32(&w.authFailures, 0)
+	}
+
+	if err != nil {
+		messageID, report := errorReply(err)
+		if report {
+			w.report(log, err)
+		} else {
+			w.markError(err)
+			log.Warningf("%v", err)
+		}
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: messageID})
+	}
+
+	msgSend := v1.MessageSendRequest{
+		Scope:  v1.MessageScopePrivate,
+		ChatID: eventData.Message.ChatID,
+	}
+
+	if msg != "" {
+		msgSend.Type = v1.MsgTypeText
+		msgSend.Content = msg
+	} else if msgProd.ID != 0 {
+		msgSend.Type = v1.MsgTypeProduct
+		msgSend.Product = &msgProd
+	}
+
+	if msgSend.Type != "" {
+		w.send(ctx, msgSend)
+	}
+}
+
+// authFailed counts the API key rejected by CRM and marks the connection broken
+// once it has been rejected config.AuthFailures times in a row, the command is
+// left unanswered then.
+func (w *Worker) authFailed(log *FieldLogger) (broken bool) {
+	threshold := config.AuthFailures
+	if threshold <= 0 {
+		threshold = defaultAuthFailures
+	}
+
+	failures := atomic.AddInt32(&w.authFailures, 1)
+	if failures < int32(threshold) {
+		return false
+	}
+
+	w.mutex.Lock()
+	conn := *w.connection
+	conn.Broken = true
+	w.connection = &conn
+	w.mutex.Unlock()
+
+	if failures == int32(threshold) {
+		log.Warningf("API key rejected %d times in a row, connection is marked as broken", failures)
+		if err := w.repo.SetBroken(&conn); err != nil {
+			w.sendSentry(err)
+		}
+	}
+
+	return true
+}
+
+// refreshLink registers the integration module with a freshly signed
+// settings link, so the link in the CRM never expires while the worker runs
+func (w *Worker) refreshLink() {
+	conn := w.getConnection()
+	mgToken := conn.MGToken
+
+	if err := refreshSettingsLink(w.repo, w.getCRMClient(), &conn); err != nil {
+		w.log().Warningf("refresh settings link: %v", err)
+		return
+	}
+
+	if conn.MGToken != mgToken {
+		w.UpdateWorker(&conn)
+	}
+}
+
+// send enqueues the message to the outbox falling back to direct sending
+func (w *Worker) send(ctx context.Context, msgSend v1.MessageSendRequest) {
+	enqueueCtx, span := tracer.Start(ctx, "outbox.enqueue")
+	err := outbox.enqueue(enqueueCtx, w.getConnection().ClientID, msgSend)
+	endSpan(span, err)
+
+	if err != nil {
+		log := w.log().With(LogFields{"chat_id": msgSend.ChatID})
+		log.Warningf("outbox enqueue err: %v", err)
+		messageSendFailuresTotal.WithLabelValues("enqueue").Inc()
+
+		_, span := tracer.Start(ctx, "mg.message_send", trace.WithSpanKind(trace.SpanKindClient))
+		start := time.Now()
+		d, status, err := w.mgClient.MessageSend(msgSend)
+		err = newMGError(status, err)
+		observeDuration(mgRequestDuration, "message_send", start, err)
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		endSpan(span, err)
+		if err != nil {
+			log.Warningf("MessageSend err: %v, data: %v", err, d)
+		}
+	}
+}
+
+// callCRM executes the CRM request through the circuit breaker of the connection,
+// only transient errors are counted as failures of the CRM.
+func (w *Worker) callCRM(ctx context.Context, method string, fn func() (int, errs.Failure)) (err error) {
+	_, span := tracer.Start(ctx, "crm."+method, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	var crmErr error
+
+	err = w.breaker.Do(func() error {
+		start := time.Now()
+		status, failure := fn()
+		crmErr = newCRMError(status, failure)
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		observeDuration(crmRequestDuration, method, start, crmErr)
+
+		if errorClass(crmErr) == ErrorClassTransient {
+			return crmErr
+		}
+
+		return nil
+	})
+
+	if err == errBreakerOpen {
+		return err
+	}
+
+	return crmErr
+}
+
+func (w *Worker) paymentTypes(ctx context.Context, clientID string) (map[string]v5.PaymentType, error) {
+	v, err := references.get(clientID, "payment-types", func() (interface{}, error) {
+		var res v5.PaymentTypesResponse
+		err := w.callCRM(ctx, "payment_types", func() (status int, er errs.Failure) {
+			res, status, er = w.getCRMClient().PaymentTypes()
+			return
+		})
+		return res.PaymentTypes, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(map[string]v5.PaymentType), nil
+}
+
+func (w *Worker) deliveryTypes(ctx context.Context, clientID string) (map[string]v5.DeliveryType, error) {
+	v, err := references.get(clientID, "delivery-types", func() (interface{}, error) {
+		var res v5.DeliveryTypesResponse
+		err := w.callCRM(ctx, "delivery_types", func() (status int, er errs.Failure) {
+			res, status, er = w.getCRMClient().DeliveryTypes()
+			return
+		})
+		return res.DeliveryTypes, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(map[string]v5.DeliveryType), nil
+}
+
+// products searches the products using the cache unless the connection
+// requires real-time stock. Cached products with stale quantity and price are
+// requested again by ids.
+func (w *Worker) products(ctx context.Context, conn *Connection, params v5.ProductsRequest) ([]v5.Product, error) {
+	cached := products.enabled() && !conn.RealtimeStock
+	if cached {
+		if res, stale, ok := products.get(conn.ClientID, params.Filter.Name); ok {
+			if !stale {
+				return res, nil
 			}
 
-			if msg != "" {
-				msgSend.Type = v1.MsgTypeText
-				msgSend.Content = msg
-			} else if msgProd.ID != 0 {
-				msgSend.Type = v1.MsgTypeProduct
-				msgSend.Product = &msgProd
+			ids := make([]int, 0, len(res))
+			for _, p := range res {
+				ids = append(ids, p.ID)
 			}
 
-			if msgSend.Type != "" {
-				d, status, err := w.mgClient.MessageSend(msgSend)
-				if err != nil {
-					w.logger.Warningf("MessageSend status: %d\nMessageSend err: %v\nMessageSend data: %v", status, err, d)
-					continue
-				}
+			fresh, err := w.searchProducts(ctx, v5.ProductsRequest{Filter: v5.ProductsFilter{Ids: ids}})
+			if err != nil {
+				return nil, err
 			}
+
+			return products.refresh(conn.ClientID, params.Filter.Name, fresh), nil
 		}
-		time.Sleep(500 * time.Millisecond)
 	}
-}
 
-func checkErrors(err errs.Failure) error {
-	if err.RuntimeErr != nil {
-		return err.RuntimeErr
+	res, err := w.searchProducts(ctx, params)
+	if err != nil {
+		return nil, err
 	}
 
-	if err.ApiErr != "" {
-		return errors.New(err.ApiErr)
+	if cached {
+		products.put(conn.ClientID, params.Filter.Name, res)
 	}
 
-	return nil
+	return res, nil
+}
+
+func (w *Worker) searchProducts(ctx context.Context, params v5.ProductsRequest) ([]v5.Product, error) {
+	var res v5.ProductsResponse
+	err := w.callCRM(ctx, "products", func() (status int, er errs.Failure) {
+		res, status, er = w.getCRMClient().Products(params)
+		return
+	})
+
+	return res.Products, err
 }
 
 func parseCommand(ci string) (co string, params v5.ProductsRequest, err error) {
@@ -246,7 +1046,7 @@ func parseCommand(ci string) (co string, params v5.ProductsRequest, err error) {
 	return
 }
 
-func (w *Worker) execCommand(message string) (resMes string, msgProd v1.MessageProduct, err error) {
+func (w *Worker) execCommand(ctx context.Context, conn *Connection, localizer *i18n.Localizer, message string) (resMes string, msgProd v1.MessageProduct, err error) {
 	var s []string
 
 	command, params, err := parseCommand(message)
@@ -256,47 +1056,47 @@ func (w *Worker) execCommand(message string) (resMes string, msgProd v1.MessageP
 
 	switch command {
 	case CommandPayment:
-		res, _, er := w.crmClient.PaymentTypes()
-		err = checkErrors(er)
+		var paymentTypes map[string]v5.PaymentType
+		paymentTypes, err = w.paymentTypes(ctx, conn.ClientID)
 		if err != nil {
 			return
 		}
-		for _, v := range res.PaymentTypes {
+		for _, v := range paymentTypes {
 			if v.Active {
 				s = append(s, v.Name)
 			}
 		}
 		if len(s) > 0 {
-			resMes = fmt.Sprintf("%s\n\n", w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "payment_options"}))
+			resMes = fmt.Sprintf("%s\n\n", localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "payment_options"}))
 		}
 	case CommandDelivery:
-		res, _, er := w.crmClient.DeliveryTypes()
-		err = checkErrors(er)
+		var deliveryTypes map[string]v5.DeliveryType
+		deliveryTypes, err = w.deliveryTypes(ctx, conn.ClientID)
 		if err != nil {
 			return
 		}
-		for _, v := range res.DeliveryTypes {
+		for _, v := range deliveryTypes {
 			if v.Active {
 				s = append(s, v.Name)
 			}
 		}
 		if len(s) > 0 {
-			resMes = fmt.Sprintf("%s\n\n", w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "delivery_options"}))
+			resMes = fmt.Sprintf("%s\n\n", localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "delivery_options"}))
 		}
 	case CommandProduct:
 		if params.Filter.Name == "" {
-			resMes = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_name_or_article"})
+			resMes = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_name_or_article"})
 			return
 		}
 
-		res, _, er := w.crmClient.Products(params)
-		err = checkErrors(er)
+		var productList []v5.Product
+		productList, err = w.products(ctx, conn, params)
 		if err != nil {
 			return
 		}
 
-		if len(res.Products) > 0 {
-			for _, vp := range res.Products {
+		if len(productList) > 0 {
+			for _, vp := range productList {
 				if vp.Active {
 					vo := searchOffer(vp.Offers, params.Filter.Name)
 					msgProd = v1.MessageProduct{
@@ -307,7 +1107,7 @@ func (w *Worker) execCommand(message string) (resMes string, msgProd v1.MessageP
 						Img:     vp.ImageURL,
 						Cost: &v1.MessageOrderCost{
 							Value:    vo.Price,
-							Currency: w.connection.Currency,
+							Currency: conn.Currency,
 						},
 					}
 
@@ -332,7 +1132,7 @@ func (w *Worker) execCommand(message string) (resMes string, msgProd v1.MessageP
 	}
 
 	if len(s) == 0 {
-		resMes = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+		resMes = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
 		return
 	}
 
@@ -372,7 +1172,7 @@ func searchOffer(offers []v5.Offer, filter string) (offer v5.Offer) {
 		}
 	}
 
-	if offer.ID == 0 {
+	if offer.ID == 0 && len(offers) > 0 {
 		offer = offers[0]
 	}
 
@@ -400,6 +1200,20 @@ func SetBotCommand(botURL, botToken string) (code int, err error) {
 	return
 }
 
+// DeleteBotCommands removes commands of the bot from MG
+func DeleteBotCommands(botURL, botToken string) (code int, err error) {
+	var client = v1.New(botURL, botToken)
+
+	for _, command := range botCommands {
+		_, code, err = client.CommandDelete(getTextCommand(command))
+		if err != nil && code != http.StatusNotFound {
+			return code, err
+		}
+	}
+
+	return code, nil
+}
+
 func getTextCommand(command string) string {
 	return strings.Replace(command, "/", "", -1)
 }
@@ -26,7 +26,8 @@ $("#but-settings").on("click", function(e) {
         {
             client_id: $(this).attr('data-clientID'),
             lang: $("select#lang").find(":selected").text(),
-            currency: $("select#currency").find(":selected").val()
+            currency: $("select#currency").find(":selected").val(),
+            realtime_stock: $("#realtime_stock").is(":checked") ? "true" : "false"
         },
         function (data) {
             M.toast({
@@ -41,6 +42,26 @@ $("#but-settings").on("click", function(e) {
     )
 });
 
+$("#but-uninstall").on("click", function(e) {
+    e.preventDefault();
+    if (!confirm($(this).attr('data-confirm'))) {
+        return;
+    }
+    $(this).addClass('disabled');
+    send(
+        $(this).attr('data-action'),
+        {
+            client_id: $(this).attr('data-clientID')
+        },
+        function (data) {
+            sessionStorage.setItem("createdMsg", data.msg);
+            document.location.replace(
+                location.protocol.concat("//").concat(window.location.host) + data.url
+            );
+        }
+    )
+});
+
 $("#save").on("submit", function(e) {
     e.preventDefault();
     let formData = formDataToObj($(this).serializeArray());
@@ -69,6 +90,7 @@ function send(url, data, callback) {
         url: url,
         data: JSON.stringify(data),
         type: "POST",
+        headers: csrfHeaders(),
         success: callback,
         error: function (res) {
             if (res.status >= 400) {
@@ -86,6 +108,11 @@ function send(url, data, callback) {
     });
 }
 
+function csrfHeaders() {
+    let token = $("#csrf_token").val();
+    return token ? {"X-CSRF-Token": token} : {};
+}
+
 function formDataToObj(formArray) {
     let obj = {};
     for (let i = 0; i < formArray.length; i++){